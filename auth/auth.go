@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+const (
+	MethodAPIKey     = "api_key"
+	MethodBasic      = "basic"
+	MethodProxyBasic = "proxy_basic"
+	MethodClientCert = "client_cert"
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Name   string
+	Method string
+}
+
+type contextKey struct{}
+
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(*Identity)
+	return id, ok
+}
+
+type Authenticator interface {
+	// Authenticate returns ErrNoCredentials when the request carries none of
+	// the credentials it understands and ErrInvalidCredentials when they are
+	// wrong.
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Chain tries each authenticator in turn. Invalid credentials for any of
+// them take precedence over missing credentials in the result.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	result := ErrNoCredentials
+	for _, a := range c {
+		id, err := a.Authenticate(r)
+		if err == nil {
+			return id, nil
+		}
+		if errors.Is(err, ErrInvalidCredentials) {
+			result = ErrInvalidCredentials
+		}
+	}
+	return nil, result
+}
+
+type APIKeyAuthenticator struct {
+	header string
+	keys   map[string]string
+}
+
+// NewAPIKeyAuthenticator accepts keys sent in header, mapping each key to
+// the client name it identifies.
+func NewAPIKeyAuthenticator(header string, keys map[string]string) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{header: header, keys: keys}
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	key := r.Header.Get(a.header)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	if name, ok := a.lookup(key); ok {
+		return &Identity{Name: name, Method: MethodAPIKey}, nil
+	}
+	return nil, ErrInvalidCredentials
+}
+
+func (a *APIKeyAuthenticator) lookup(key string) (string, bool) {
+	for candidate, name := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+type BasicAuthenticator struct {
+	header  string
+	method  string
+	users   *Htpasswd
+	apiKeys *APIKeyAuthenticator
+}
+
+// NewBasicAuthenticator checks HTTP Basic credentials in the Authorization
+// header against an htpasswd file.
+func NewBasicAuthenticator(users *Htpasswd) *BasicAuthenticator {
+	return &BasicAuthenticator{header: "Authorization", method: MethodBasic, users: users}
+}
+
+// NewProxyAuthenticator checks Basic credentials in Proxy-Authorization.
+// Besides htpasswd users it accepts an API key as the password, which lets
+// clients that only support user:password proxy URLs authenticate by key.
+func NewProxyAuthenticator(users *Htpasswd, apiKeys *APIKeyAuthenticator) *BasicAuthenticator {
+	return &BasicAuthenticator{header: "Proxy-Authorization", method: MethodProxyBasic, users: users, apiKeys: apiKeys}
+}
+
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := parseBasic(r.Header.Get(a.header))
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	if a.users != nil && a.users.Verify(username, password) {
+		return &Identity{Name: username, Method: a.method}, nil
+	}
+
+	if a.apiKeys != nil {
+		if name, ok := a.apiKeys.lookup(password); ok {
+			return &Identity{Name: name, Method: a.method}, nil
+		}
+	}
+
+	return nil, ErrInvalidCredentials
+}
+
+func parseBasic(header string) (string, string, bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	return username, password, ok
+}
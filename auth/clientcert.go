@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/http"
+)
+
+// ClientCertAuthenticator identifies callers by the TLS client certificate
+// the listener verified during the handshake.
+type ClientCertAuthenticator struct {
+	name func(*x509.Certificate) string
+}
+
+// NewClientCertAuthenticator names clients by the part of their certificate
+// that name returns.
+func NewClientCertAuthenticator(name func(*x509.Certificate) string) *ClientCertAuthenticator {
+	return &ClientCertAuthenticator{name: name}
+}
+
+func (a *ClientCertAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	cert := VerifiedClientCert(r)
+	if cert == nil {
+		return nil, ErrNoCredentials
+	}
+	name := a.name(cert)
+	if name == "" {
+		// A trusted certificate that lacks the identifying field.
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Name: name, Method: MethodClientCert}, nil
+}
+
+// VerifiedClientCert returns the client certificate of r if it was verified
+// against the configured CAs, and nil otherwise.
+func VerifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd holds users from an Apache htpasswd file. Only bcrypt hashes
+// ($2y$, $2a$, $2b$) are accepted.
+type Htpasswd struct {
+	users map[string][]byte
+
+	// verified remembers digests of credentials that already passed bcrypt,
+	// which is far too slow to run on every proxied request.
+	verified sync.Map
+}
+
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open htpasswd file: %w", err)
+	}
+	defer file.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("htpasswd line %d: expected user:hash", lineNo)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("htpasswd line %d: user %s does not have a bcrypt hash", lineNo, username)
+		}
+		users[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+
+	return &Htpasswd{users: users}, nil
+}
+
+func (h *Htpasswd) Verify(username, password string) bool {
+	hash, ok := h.users[username]
+	if !ok {
+		// Compare against a dummy hash so unknown users take as long as
+		// known ones.
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(username + ":" + password + ":" + string(hash)))
+	if _, ok := h.verified.Load(digest); ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	h.verified.Store(digest, struct{}{})
+	return true
+}
+
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	return hash
+})
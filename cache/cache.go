@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Entry struct {
+	Key          string            `json:"key"`
+	StatusCode   int               `json:"status_code"`
+	Header       http.Header       `json:"header"`
+	Body         []byte            `json:"body"`
+	Vary         map[string]string `json:"vary,omitempty"`
+	RequestTime  time.Time         `json:"request_time"`
+	ResponseTime time.Time         `json:"response_time"`
+}
+
+func (e *Entry) size() int64 {
+	n := int64(len(e.Key) + len(e.Body))
+	for name, values := range e.Header {
+		n += int64(len(name))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(key string, entry *Entry)
+	Delete(key string)
+}
+
+type Status int
+
+const (
+	Miss Status = iota
+	Fresh
+	Stale
+)
+
+type Cache struct {
+	store         Store
+	maxEntryBytes int64
+}
+
+func New(store Store, maxEntryBytes int64) *Cache {
+	return &Cache{
+		store:         store,
+		maxEntryBytes: maxEntryBytes,
+	}
+}
+
+func (c *Cache) MaxEntryBytes() int64 {
+	return c.maxEntryBytes
+}
+
+// Lookup returns the stored response for key if it was produced for a request
+// with the same Vary header values, along with whether it can be served
+// without contacting the origin.
+func (c *Cache) Lookup(key string, req *http.Request, now time.Time) (*Entry, Status) {
+	entry, ok := c.store.Get(key)
+	if !ok {
+		return nil, Miss
+	}
+
+	if !varyMatches(entry, req) {
+		return nil, Miss
+	}
+
+	if isFresh(entry, req, now) {
+		return entry, Fresh
+	}
+	return entry, Stale
+}
+
+// Store saves resp with its fully read body when the HTTP caching rules
+// allow a shared cache to keep it.
+func (c *Cache) Store(key string, req *http.Request, resp *http.Response, body []byte, requestTime, responseTime time.Time) bool {
+	if int64(len(body)) > c.maxEntryBytes || !Storable(req, resp) {
+		return false
+	}
+
+	entry := &Entry{
+		Key:          key,
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Body:         body,
+		Vary:         varyValues(req, resp.Header),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	c.store.Set(key, entry)
+	return true
+}
+
+// Revalidated refreshes a stored entry from a 304 Not Modified response and
+// returns the updated copy.
+func (c *Cache) Revalidated(entry *Entry, resp *http.Response, requestTime, responseTime time.Time) *Entry {
+	updated := *entry
+	updated.Header = entry.Header.Clone()
+	for name, values := range resp.Header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = responseTime
+
+	c.store.Set(entry.Key, &updated)
+	return &updated
+}
+
+func (c *Cache) Invalidate(key string) {
+	c.store.Delete(key)
+}
+
+// Age is the current age of the entry as defined by RFC 9111 section 4.2.3.
+func Age(e *Entry, now time.Time) time.Duration {
+	apparent := time.Duration(0)
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		if d := e.ResponseTime.Sub(date); d > 0 {
+			apparent = d
+		}
+	}
+
+	corrected := e.ResponseTime.Sub(e.RequestTime)
+	if age, err := strconv.Atoi(e.Header.Get("Age")); err == nil && age > 0 {
+		corrected += time.Duration(age) * time.Second
+	}
+
+	initial := apparent
+	if corrected > initial {
+		initial = corrected
+	}
+	return initial + now.Sub(e.ResponseTime)
+}
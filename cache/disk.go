@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DiskStore keeps each entry in its own JSON file named after the hash of
+// its key. An in-memory index of sizes drives LRU eviction; entries found on
+// disk at startup are indexed oldest first by modification time.
+type DiskStore struct {
+	dir string
+
+	mu  sync.Mutex
+	lru *lru
+}
+
+func NewDiskStore(dir string, maxBytes int64) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	store := &DiskStore{
+		dir: dir,
+		lru: newLRU(maxBytes),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	type existing struct {
+		key  string
+		size int64
+		mod  int64
+	}
+	var found []existing
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, existing{
+			key:  strings.TrimSuffix(f.Name(), ".json"),
+			size: info.Size(),
+			mod:  info.ModTime().UnixNano(),
+		})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].mod < found[j].mod })
+
+	for _, f := range found {
+		for _, evicted := range store.lru.add(f.key, f.size, nil) {
+			os.Remove(store.path(evicted))
+		}
+	}
+
+	return store, nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *DiskStore) path(hashed string) string {
+	return filepath.Join(s.dir, hashed+".json")
+}
+
+func (s *DiskStore) Get(key string) (*Entry, bool) {
+	hashed := hashKey(key)
+
+	s.mu.Lock()
+	_, ok := s.lru.get(hashed)
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(s.path(hashed))
+	if err != nil {
+		s.Delete(key)
+		return nil, false
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Key != key {
+		s.Delete(key)
+		return nil, false
+	}
+	return &entry, true
+}
+
+func (s *DiskStore) Set(key string, entry *Entry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	hashed := hashKey(key)
+	tmp, err := os.CreateTemp(s.dir, hashed+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, werr := tmp.Write(data)
+	cerr := tmp.Close()
+	if werr != nil || cerr != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(tmp.Name(), s.path(hashed)); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	for _, evicted := range s.lru.add(hashed, int64(len(data)), nil) {
+		os.Remove(s.path(evicted))
+	}
+}
+
+func (s *DiskStore) Delete(key string) {
+	hashed := hashKey(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.remove(hashed)
+	os.Remove(s.path(hashed))
+}
@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru tracks keys in recency order together with their size so that both
+// backends can evict down to a byte budget.
+type lru struct {
+	maxBytes int64
+	size     int64
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	entry *Entry
+}
+
+func newLRU(maxBytes int64) *lru {
+	return &lru{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (l *lru) get(key string) (*lruItem, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruItem), true
+}
+
+// add inserts or replaces key and returns the keys evicted to stay within
+// the byte budget.
+func (l *lru) add(key string, size int64, entry *Entry) []string {
+	if el, ok := l.items[key]; ok {
+		item := el.Value.(*lruItem)
+		l.size += size - item.size
+		item.size = size
+		item.entry = entry
+		l.order.MoveToFront(el)
+	} else {
+		l.items[key] = l.order.PushFront(&lruItem{key: key, size: size, entry: entry})
+		l.size += size
+	}
+
+	var evicted []string
+	for l.size > l.maxBytes && l.order.Len() > 0 {
+		oldest := l.order.Back()
+		item := oldest.Value.(*lruItem)
+		l.remove(item.key)
+		evicted = append(evicted, item.key)
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) {
+	el, ok := l.items[key]
+	if !ok {
+		return
+	}
+	l.size -= el.Value.(*lruItem).size
+	l.order.Remove(el)
+	delete(l.items, key)
+}
+
+type MemoryStore struct {
+	mu  sync.Mutex
+	lru *lru
+}
+
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{lru: newLRU(maxBytes)}
+}
+
+func (s *MemoryStore) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.lru.get(key)
+	if !ok {
+		return nil, false
+	}
+	return item.entry, true
+}
+
+func (s *MemoryStore) Set(key string, entry *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.add(key, entry.size(), entry)
+}
+
+func (s *MemoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.remove(key)
+}
+
+func (s *MemoryStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.size
+}
@@ -0,0 +1,251 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxHeuristicLifetime = 24 * time.Hour
+
+// Status codes that may be cached without explicit freshness information
+// (RFC 9110 section 15.1).
+var heuristicStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, line := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(line, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(directive, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// Cacheable reports whether req may be answered from or stored in the cache
+// at all. Entries hold whole bodies, so ranged requests bypass the cache.
+func Cacheable(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return false
+	}
+	return !parseCacheControl(req.Header).has("no-store")
+}
+
+// Storable applies the shared-cache storage rules of RFC 9111 section 3.
+func Storable(req *http.Request, resp *http.Response) bool {
+	if !Cacheable(req) {
+		return false
+	}
+
+	// Only status codes whose meaning the cache understands are stored,
+	// which rules out fragments such as 206 Partial Content.
+	if !heuristicStatus[resp.StatusCode] {
+		return false
+	}
+
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+
+	if strings.TrimSpace(resp.Header.Get("Vary")) == "*" {
+		return false
+	}
+
+	// Responses that set cookies are specific to one client.
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+
+	explicit := cc.has("public") || cc.has("s-maxage")
+	if req.Header.Get("Authorization") != "" && !explicit && !cc.has("must-revalidate") {
+		return false
+	}
+
+	if explicit || cc.has("max-age") || resp.Header.Get("Expires") != "" {
+		return true
+	}
+
+	// Without freshness information an entry is only worth keeping if it can
+	// be revalidated later.
+	return resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+func freshnessLifetime(e *Entry) time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		date = e.ResponseTime
+	}
+
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(date)
+	}
+
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && heuristicStatus[e.StatusCode] {
+		lifetime := date.Sub(lastModified) / 10
+		if lifetime > maxHeuristicLifetime {
+			lifetime = maxHeuristicLifetime
+		}
+		return lifetime
+	}
+
+	return 0
+}
+
+func isFresh(e *Entry, req *http.Request, now time.Time) bool {
+	respCC := parseCacheControl(e.Header)
+	if respCC.has("no-cache") {
+		return false
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	if reqCC.has("no-cache") || (len(reqCC) == 0 && req.Header.Get("Pragma") == "no-cache") {
+		return false
+	}
+
+	age := Age(e, now)
+	lifetime := freshnessLifetime(e)
+
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok {
+		age += minFresh
+	}
+
+	return lifetime > age
+}
+
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+func varyValues(req *http.Request, respHeader http.Header) map[string]string {
+	names := varyNames(respHeader)
+	if len(names) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(names))
+	for _, name := range names {
+		values[name] = strings.Join(req.Header.Values(name), ",")
+	}
+	return values
+}
+
+func varyMatches(e *Entry, req *http.Request) bool {
+	for _, name := range varyNames(e.Header) {
+		if strings.Join(req.Header.Values(name), ",") != e.Vary[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// SetConditionalHeaders adds the validators of a stale entry to an outgoing
+// request so the origin can answer with 304 Not Modified. It reports whether
+// the entry had any validators.
+func SetConditionalHeaders(h http.Header, e *Entry) bool {
+	ok := false
+	if etag := e.Header.Get("ETag"); etag != "" {
+		h.Set("If-None-Match", etag)
+		ok = true
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		h.Set("If-Modified-Since", lastModified)
+		ok = true
+	}
+	return ok
+}
+
+func HasConditionalHeaders(h http.Header) bool {
+	return h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != ""
+}
+
+// NotModified reports whether the client's own conditional headers are
+// satisfied by the entry, so a 304 can be returned instead of the body.
+func NotModified(req *http.Request, e *Entry) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+		return !lastModified.After(since)
+	}
+
+	return false
+}
@@ -1,38 +1,382 @@
 package config
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRouteName identifies the catch-all route built from Config.Target.
+const DefaultRouteName = "default"
+
+const (
+	StrategyRoundRobin = "round_robin"
+	StrategyWeighted   = "weighted"
+	StrategyRandom     = "random"
+)
+
+const (
+	RateLimitKeyAPIKey = "api_key"
+	RateLimitKeyIP     = "ip"
+	RateLimitKeyRoute  = "route"
+)
+
+const (
+	CacheBackendMemory = "memory"
+	CacheBackendDisk   = "disk"
+)
+
+const (
+	LogOutputStdout = "stdout"
+	LogOutputStderr = "stderr"
+)
+
+const (
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+	TracingExporterFile   = "file"
+)
+
+// Forwarding header modes choose which headers tell the target about the
+// original client.
+const (
+	ForwardedHeadersXForwarded = "x-forwarded"
+	ForwardedHeadersRFC7239    = "forwarded"
+	ForwardedHeadersBoth       = "both"
+	ForwardedHeadersNone       = "none"
+)
+
+// Header rule actions.
+const (
+	HeaderActionAdd     = "add"
+	HeaderActionSet     = "set"
+	HeaderActionRemove  = "remove"
+	HeaderActionReplace = "replace"
+)
+
+// HeaderVariables are the names a header rule value may refer to as
+// ${name}.
+var HeaderVariables = []string{"client_ip", "request_id", "target_host", "route", "host", "method", "path"}
+
+// Client certificate modes for the TLS listener.
+const (
+	ClientCertNone     = "none"
+	ClientCertOptional = "optional"
+	ClientCertRequire  = "require"
+)
+
+// ClientCertFields are the client certificate details that can name the
+// client or be passed to the target.
+var ClientCertFields = []string{"common_name", "subject", "issuer", "serial", "fingerprint", "dns", "email", "uri", "not_after"}
+
+const (
+	AccessLogFormatCombined = "combined"
+	AccessLogFormatW3C      = "w3c"
+	AccessLogFormatJSON     = "json"
 )
 
 type Config struct {
-	Server ServerConfig `json:"server"`
-	Target TargetConfig `json:"target"`
-	Proxy  ProxyConfig  `json:"proxy"`
-	Logging LoggingConfig `json:"logging"`
+	Server    ServerConfig    `json:"server"`
+	Target    TargetConfig    `json:"target"`
+	Proxy     ProxyConfig     `json:"proxy"`
+	Logging   LoggingConfig   `json:"logging"`
+	AccessLog AccessLogConfig `json:"access_log"`
+	Routes    []RouteConfig   `json:"routes,omitempty"`
+	Cache     CacheConfig     `json:"cache"`
+	Retry     RetryConfig     `json:"retry"`
+	Forward   ForwardConfig   `json:"forward"`
+	Auth      AuthConfig      `json:"auth"`
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	Recording RecordingConfig `json:"recording"`
+	Tracing   TracingConfig   `json:"tracing"`
+	Streaming StreamingConfig `json:"streaming"`
+	Upgrade   UpgradeConfig   `json:"upgrade"`
+
+	ForwardedHeaders ForwardedHeadersConfig `json:"forwarded_headers"`
+	Headers          HeaderRulesConfig      `json:"headers"`
+	Rewrite          RewriteConfig          `json:"rewrite"`
 }
 
 type ServerConfig struct {
-	Port int    `json:"port"`
-	Host string `json:"host"`
+	Port               int             `json:"port"`
+	Host               string          `json:"host"`
+	ConfigPollInterval Duration        `json:"config_poll_interval,omitempty"`
+	TLS                TLSServerConfig `json:"tls,omitempty"`
+}
+
+// TLSServerConfig serves HTTPS on the server port. CertFile and KeyFile are
+// the default certificate; Certificates adds more, chosen by SNI. Certificate
+// files are checked for changes every ReloadInterval. RedirectPort, if set,
+// is a plain HTTP port that redirects to HTTPS.
+type TLSServerConfig struct {
+	Enabled        bool                `json:"enabled"`
+	CertFile       string              `json:"cert_file,omitempty"`
+	KeyFile        string              `json:"key_file,omitempty"`
+	Certificates   []CertificateConfig `json:"certificates,omitempty"`
+	MinVersion     string              `json:"min_version,omitempty"`
+	CipherSuites   []string            `json:"cipher_suites,omitempty"`
+	ReloadInterval Duration            `json:"reload_interval,omitempty"`
+	RedirectPort   int                 `json:"redirect_port,omitempty"`
+	ClientCerts    ClientCertConfig    `json:"client_certs,omitempty"`
+}
+
+// ClientCertConfig asks TLS clients for a certificate issued by one of the
+// CAs in CAFile. The certificate field named by Identity becomes the
+// client's name, and Header, if set, passes the listed Fields to the target.
+type ClientCertConfig struct {
+	Mode     string   `json:"mode,omitempty"`
+	CAFile   string   `json:"ca_file,omitempty"`
+	Identity string   `json:"identity,omitempty"`
+	Header   string   `json:"header,omitempty"`
+	Fields   []string `json:"fields,omitempty"`
+}
+
+// Enabled reports whether clients are asked for certificates at all.
+func (c *ClientCertConfig) Enabled() bool {
+	return c.Mode != "" && c.Mode != ClientCertNone
+}
+
+type CertificateConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// CertificateList returns the configured certificates, default first.
+func (t *TLSServerConfig) CertificateList() []CertificateConfig {
+	var certs []CertificateConfig
+	if t.CertFile != "" || t.KeyFile != "" {
+		certs = append(certs, CertificateConfig{CertFile: t.CertFile, KeyFile: t.KeyFile})
+	}
+	return append(certs, t.Certificates...)
 }
 
 type TargetConfig struct {
-	Scheme string `json:"scheme"`
-	Host   string `json:"host"`
+	Scheme string          `json:"scheme"`
+	Host   string          `json:"host"`
+	TLS    TargetTLSConfig `json:"tls,omitempty"`
+}
+
+// TargetTLSConfig changes how connections to an https target are verified.
+// CAFile replaces the system roots, CertFile and KeyFile are presented to
+// targets that want a client certificate, and ServerName overrides the name
+// sent in SNI and checked against the certificate. PinnedKeys, given as
+// "sha256/<base64>" hashes of a SubjectPublicKeyInfo, must match a key in
+// the target's chain. InsecureSkipVerify turns verification off entirely.
+type TargetTLSConfig struct {
+	CAFile             string   `json:"ca_file,omitempty"`
+	CertFile           string   `json:"cert_file,omitempty"`
+	KeyFile            string   `json:"key_file,omitempty"`
+	ServerName         string   `json:"server_name,omitempty"`
+	PinnedKeys         []string `json:"pinned_keys,omitempty"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify,omitempty"`
+}
+
+// IsZero reports whether no TLS settings are given, leaving the defaults.
+func (t *TargetTLSConfig) IsZero() bool {
+	return t.CAFile == "" && t.CertFile == "" && t.KeyFile == "" && t.ServerName == "" &&
+		len(t.PinnedKeys) == 0 && !t.InsecureSkipVerify
+}
+
+type RouteConfig struct {
+	Name          string            `json:"name"`
+	Host          string            `json:"host,omitempty"`
+	PathPrefix    string            `json:"path_prefix,omitempty"`
+	StripPrefix   bool              `json:"strip_prefix,omitempty"`
+	RewritePrefix string            `json:"rewrite_prefix,omitempty"`
+	Target        TargetConfig      `json:"target"`
+	Streaming     StreamingConfig   `json:"streaming,omitempty"`
+	Headers       HeaderRulesConfig `json:"headers,omitempty"`
+	Rewrite       RewriteConfig     `json:"rewrite,omitempty"`
+}
+
+// RewriteConfig maps the target's origin back to the proxy's public origin
+// in responses, so that redirects, cookies and links keep clients on the
+// proxy. PublicURL defaults to the scheme and Host the client used. Routes
+// without rewriting enabled use the top-level settings.
+type RewriteConfig struct {
+	Enabled      bool     `json:"enabled"`
+	PublicURL    string   `json:"public_url,omitempty"`
+	Body         bool     `json:"body,omitempty"`
+	ContentTypes []string `json:"content_types,omitempty"`
+}
+
+// HeaderRulesConfig lists changes made to request headers before they are
+// sent to the target and to response headers before they reach the client.
+// Route rules run after the top-level ones.
+type HeaderRulesConfig struct {
+	Request  []HeaderRule `json:"request,omitempty"`
+	Response []HeaderRule `json:"response,omitempty"`
+}
+
+// HeaderRule changes one header. Value may refer to HeaderVariables as
+// ${name}; for "replace" it is the replacement for matches of Pattern and may
+// also refer to capture groups as $1.
+type HeaderRule struct {
+	Action  string `json:"action"`
+	Name    string `json:"name"`
+	Value   string `json:"value,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// StreamingConfig controls responses streamed to the client, such as
+// server-sent events. Zero values on a route inherit the top-level settings.
+type StreamingConfig struct {
+	FlushInterval Duration `json:"flush_interval,omitempty"`
+	WriteTimeout  Duration `json:"write_timeout,omitempty"`
+}
+
+// UpgradeConfig controls WebSocket and other Upgrade requests, which are
+// tunnelled to the target once it switches protocols.
+type UpgradeConfig struct {
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
 }
 
 type ProxyConfig struct {
+	URL             string           `json:"url"`
+	Username        string           `json:"username"`
+	Password        string           `json:"password"`
+	Upstreams       []UpstreamConfig `json:"upstreams,omitempty"`
+	Strategy        string           `json:"strategy,omitempty"`
+	MaxFailures     int              `json:"max_failures,omitempty"`
+	FailureCooldown Duration         `json:"failure_cooldown,omitempty"`
+	Timeout         Duration         `json:"timeout,omitempty"`
+}
+
+type UpstreamConfig struct {
 	URL      string `json:"url"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
+}
+
+// Duration is a time.Duration that is written as a string such as "30s" in
+// the configuration file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type CacheConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Backend       string `json:"backend,omitempty"`
+	Dir           string `json:"dir,omitempty"`
+	MaxBytes      int64  `json:"max_bytes,omitempty"`
+	MaxEntryBytes int64  `json:"max_entry_bytes,omitempty"`
+}
+
+type RetryConfig struct {
+	MaxAttempts    int      `json:"max_attempts,omitempty"`
+	Methods        []string `json:"methods,omitempty"`
+	StatusCodes    []int    `json:"status_codes,omitempty"`
+	InitialBackoff Duration `json:"initial_backoff,omitempty"`
+	MaxBackoff     Duration `json:"max_backoff,omitempty"`
+	Budget         Duration `json:"budget,omitempty"`
+	MaxBodyBytes   int64    `json:"max_body_bytes,omitempty"`
+}
+
+type ForwardConfig struct {
+	Enabled           bool     `json:"enabled"`
+	AllowedHosts      []string `json:"allowed_hosts,omitempty"`
+	DeniedHosts       []string `json:"denied_hosts,omitempty"`
+	AllowedPorts      []int    `json:"allowed_ports,omitempty"`
+	TunnelIdleTimeout Duration `json:"tunnel_idle_timeout,omitempty"`
+}
+
+// ForwardedHeadersConfig controls the X-Forwarded-* and RFC 7239 Forwarded
+// headers sent to targets. Chains sent by the client are only extended when
+// it connected from one of the trusted proxies; otherwise they are replaced.
+type ForwardedHeadersConfig struct {
+	Mode           string   `json:"mode,omitempty"`
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+}
+
+type AuthConfig struct {
+	Enabled      bool           `json:"enabled"`
+	APIKeyHeader string         `json:"api_key_header,omitempty"`
+	APIKeys      []APIKeyConfig `json:"api_keys,omitempty"`
+	HtpasswdFile string         `json:"htpasswd_file,omitempty"`
+	Realm        string         `json:"realm,omitempty"`
+}
+
+type RecordingConfig struct {
+	Enabled        bool     `json:"enabled"`
+	File           string   `json:"file,omitempty"`
+	MaxBodyBytes   int64    `json:"max_body_bytes,omitempty"`
+	RedactHeaders  []string `json:"redact_headers,omitempty"`
+	RedactQuery    []string `json:"redact_query,omitempty"`
+	RedactPatterns []string `json:"redact_patterns,omitempty"`
+}
+
+type TracingConfig struct {
+	Enabled     bool              `json:"enabled"`
+	ServiceName string            `json:"service_name,omitempty"`
+	Exporter    string            `json:"exporter,omitempty"`
+	Endpoint    string            `json:"endpoint,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	File        string            `json:"file,omitempty"`
+	SampleRatio *float64          `json:"sample_ratio,omitempty"`
+}
+
+type APIKeyConfig struct {
+	Client string `json:"client"`
+	Key    string `json:"key"`
+}
+
+type RateLimitConfig struct {
+	Enabled           bool                    `json:"enabled"`
+	Key               string                  `json:"key,omitempty"`
+	RequestsPerSecond float64                 `json:"requests_per_second,omitempty"`
+	Burst             int                     `json:"burst,omitempty"`
+	MaxWait           Duration                `json:"max_wait,omitempty"`
+	Upstream          UpstreamRateLimitConfig `json:"upstream"`
+}
+
+type UpstreamRateLimitConfig struct {
+	RequestsPerSecond float64  `json:"requests_per_second,omitempty"`
+	Burst             int      `json:"burst,omitempty"`
+	MaxWait           Duration `json:"max_wait,omitempty"`
 }
 
 type LoggingConfig struct {
-	Level  string `json:"level"`
-	Format string `json:"format"`
+	Level          string   `json:"level"`
+	Format         string   `json:"format"`
+	Output         string   `json:"output,omitempty"`
+	MaxBytes       int64    `json:"max_bytes,omitempty"`
+	RotateInterval Duration `json:"rotate_interval,omitempty"`
+	MaxBackups     int      `json:"max_backups,omitempty"`
+}
+
+type AccessLogConfig struct {
+	Enabled        bool     `json:"enabled"`
+	File           string   `json:"file"`
+	Format         string   `json:"format,omitempty"`
+	MaxBytes       int64    `json:"max_bytes,omitempty"`
+	RotateInterval Duration `json:"rotate_interval,omitempty"`
+	Compress       bool     `json:"compress,omitempty"`
 }
 
 func LoadConfig(configPath string) (*Config, error) {
@@ -98,6 +442,14 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("invalid server port: %d", config.Server.Port)
 	}
 
+	if config.Server.ConfigPollInterval < 0 {
+		return fmt.Errorf("config poll interval must not be negative")
+	}
+
+	if err := validateServerTLS(&config.Server); err != nil {
+		return err
+	}
+
 	if config.Target.Host == "" {
 		return fmt.Errorf("target host is required")
 	}
@@ -106,21 +458,734 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("invalid target scheme: %s", config.Target.Scheme)
 	}
 
-	if config.Proxy.URL == "" {
+	if err := validateTargetTLS(&config.Target); err != nil {
+		return fmt.Errorf("target %s: %w", config.Target.Host, err)
+	}
+
+	seen := make(map[string]bool)
+	for i, route := range config.Routes {
+		if err := validateRoute(route); err != nil {
+			return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+		}
+		if seen[route.Name] {
+			return fmt.Errorf("duplicate route name: %s", route.Name)
+		}
+		seen[route.Name] = true
+	}
+
+	if err := validateTargetHosts(config); err != nil {
+		return err
+	}
+
+	if err := validateProxy(&config.Proxy); err != nil {
+		return err
+	}
+
+	if err := validateStreaming(&config.Streaming); err != nil {
+		return err
+	}
+
+	if config.Upgrade.IdleTimeout < 0 {
+		return fmt.Errorf("upgrade idle timeout must not be negative")
+	}
+
+	if err := validateLogging(&config.Logging); err != nil {
+		return err
+	}
+
+	if err := validateAccessLog(&config.AccessLog); err != nil {
+		return err
+	}
+
+	if err := validateCache(&config.Cache); err != nil {
+		return err
+	}
+
+	if err := validateRetry(&config.Retry); err != nil {
+		return err
+	}
+
+	if err := validateForward(&config.Forward); err != nil {
+		return err
+	}
+
+	if err := validateHeaderRules(&config.Headers); err != nil {
+		return err
+	}
+
+	if err := validateRewrite(&config.Rewrite); err != nil {
+		return err
+	}
+
+	if err := validateForwardedHeaders(&config.ForwardedHeaders); err != nil {
+		return err
+	}
+
+	if err := validateAuth(&config.Auth, &config.Server.TLS.ClientCerts); err != nil {
+		return err
+	}
+
+	if err := validateRateLimit(&config.RateLimit); err != nil {
+		return err
+	}
+
+	if err := validateRecording(&config.Recording); err != nil {
+		return err
+	}
+
+	if err := validateTracing(&config.Tracing); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func validateProxy(proxy *ProxyConfig) error {
+	switch proxy.Strategy {
+	case "", StrategyRoundRobin, StrategyWeighted, StrategyRandom:
+	default:
+		return fmt.Errorf("invalid proxy strategy: %s", proxy.Strategy)
+	}
+
+	if proxy.MaxFailures < 0 {
+		return fmt.Errorf("proxy max failures must not be negative")
+	}
+
+	if proxy.FailureCooldown < 0 {
+		return fmt.Errorf("proxy failure cooldown must not be negative")
+	}
+
+	if proxy.Timeout < 0 {
+		return fmt.Errorf("proxy timeout must not be negative")
+	}
+
+	if len(proxy.Upstreams) > 0 {
+		for i, upstream := range proxy.Upstreams {
+			if upstream.URL == "" {
+				return fmt.Errorf("upstream proxy %d: URL is required", i)
+			}
+			if err := validateProxyURL(upstream.URL, upstream.Username, upstream.Password); err != nil {
+				return fmt.Errorf("upstream proxy %d: %w", i, err)
+			}
+			if upstream.Weight < 0 {
+				return fmt.Errorf("upstream proxy %d: weight must not be negative", i)
+			}
+		}
+		return nil
+	}
+
+	if proxy.URL == "" {
 		return fmt.Errorf("proxy URL is required")
 	}
 
-	if config.Proxy.Username == "" {
+	if proxy.Username == "" {
 		return fmt.Errorf("proxy username is required")
 	}
 
-	if config.Proxy.Password == "" {
+	if proxy.Password == "" {
 		return fmt.Errorf("proxy password is required")
 	}
 
+	return validateProxyURL(proxy.URL, proxy.Username, proxy.Password)
+}
+
+// validateProxyURL checks that an upstream proxy is HTTP, HTTPS or SOCKS5,
+// and that SOCKS credentials fit RFC 1929.
+func validateProxyURL(raw, username, password string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid proxy URL %q: host is required", u.Redacted())
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+	case "socks5", "socks5h":
+		if username == "" && password == "" && u.User != nil {
+			username = u.User.Username()
+			password, _ = u.User.Password()
+		}
+		if len(username) > 255 || len(password) > 255 || (username == "" && password != "") {
+			return fmt.Errorf("SOCKS proxy username must be 1 to 255 bytes and password at most 255")
+		}
+	default:
+		return fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+	}
+	return nil
+}
+
+func validateLogging(logging *LoggingConfig) error {
+	if logging.MaxBytes < 0 || logging.RotateInterval < 0 || logging.MaxBackups < 0 {
+		return fmt.Errorf("log rotation settings must not be negative")
+	}
+
+	if logging.Output == LogOutputStdout || logging.Output == LogOutputStderr || logging.Output == "" {
+		if logging.MaxBytes > 0 || logging.RotateInterval > 0 {
+			return fmt.Errorf("log rotation requires a log file output")
+		}
+	}
+
+	return nil
+}
+
+func validateServerTLS(server *ServerConfig) error {
+	t := &server.TLS
+	if !t.Enabled {
+		if t.ClientCerts.Enabled() {
+			return fmt.Errorf("client certificates require TLS")
+		}
+		return nil
+	}
+
+	certs := t.CertificateList()
+	if len(certs) == 0 {
+		return fmt.Errorf("TLS requires a certificate")
+	}
+	for i, cert := range certs {
+		if cert.CertFile == "" || cert.KeyFile == "" {
+			return fmt.Errorf("TLS certificate %d: cert and key files are required", i)
+		}
+	}
+
+	if _, err := ParseTLSVersion(t.MinVersion); err != nil {
+		return err
+	}
+
+	if _, err := ParseCipherSuites(t.CipherSuites); err != nil {
+		return err
+	}
+
+	if t.ReloadInterval < 0 {
+		return fmt.Errorf("TLS reload interval must not be negative")
+	}
+
+	if t.RedirectPort < 0 || t.RedirectPort > 65535 || t.RedirectPort == server.Port {
+		return fmt.Errorf("invalid TLS redirect port: %d", t.RedirectPort)
+	}
+
+	return validateClientCerts(&t.ClientCerts)
+}
+
+func validateTargetTLS(target *TargetConfig) error {
+	t := &target.TLS
+	if t.IsZero() {
+		return nil
+	}
+
+	if target.Scheme != "https" {
+		return fmt.Errorf("TLS settings require an https target")
+	}
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("TLS client certificate requires both cert and key files")
+	}
+
+	for _, pin := range t.PinnedKeys {
+		if _, err := ParseSPKIPin(pin); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateTargetHosts makes sure that targets sharing a host agree on their
+// TLS settings, as connections to a host are pooled.
+func validateTargetHosts(config *Config) error {
+	settings := map[string]*TargetTLSConfig{strings.ToLower(config.Target.Host): &config.Target.TLS}
+	for i := range config.Routes {
+		target := &config.Routes[i].Target
+		host := strings.ToLower(target.Host)
+		if other, ok := settings[host]; ok && !sameTargetTLS(other, &target.TLS) {
+			return fmt.Errorf("route %s: TLS settings for %s differ from another target on the same host", config.Routes[i].Name, target.Host)
+		}
+		settings[host] = &target.TLS
+	}
 	return nil
 }
 
+func sameTargetTLS(a, b *TargetTLSConfig) bool {
+	return a.CAFile == b.CAFile && a.CertFile == b.CertFile && a.KeyFile == b.KeyFile &&
+		a.ServerName == b.ServerName && slices.Equal(a.PinnedKeys, b.PinnedKeys) &&
+		a.InsecureSkipVerify == b.InsecureSkipVerify
+}
+
+func validateClientCerts(certs *ClientCertConfig) error {
+	switch certs.Mode {
+	case "", ClientCertNone:
+		return nil
+	case ClientCertOptional, ClientCertRequire:
+	default:
+		return fmt.Errorf("invalid client certificate mode: %s", certs.Mode)
+	}
+
+	if certs.CAFile == "" {
+		return fmt.Errorf("client certificates require a CA file")
+	}
+
+	if certs.Identity != "" && !slices.Contains(ClientCertFields, certs.Identity) {
+		return fmt.Errorf("invalid client certificate identity: %s", certs.Identity)
+	}
+
+	if len(certs.Fields) > 0 && certs.Header == "" {
+		return fmt.Errorf("client certificate fields require a header")
+	}
+	for _, field := range certs.Fields {
+		if !slices.Contains(ClientCertFields, field) {
+			return fmt.Errorf("invalid client certificate field: %s", field)
+		}
+	}
+
+	return nil
+}
+
+func validateStreaming(streaming *StreamingConfig) error {
+	if streaming.FlushInterval < 0 {
+		return fmt.Errorf("streaming flush interval must not be negative")
+	}
+
+	if streaming.WriteTimeout < 0 {
+		return fmt.Errorf("streaming write timeout must not be negative")
+	}
+
+	return nil
+}
+
+func validateAccessLog(accessLog *AccessLogConfig) error {
+	switch accessLog.Format {
+	case "", AccessLogFormatCombined, AccessLogFormatW3C, AccessLogFormatJSON:
+	default:
+		return fmt.Errorf("invalid access log format: %s", accessLog.Format)
+	}
+
+	if accessLog.Enabled && accessLog.File == "" {
+		return fmt.Errorf("access log file is required")
+	}
+
+	if accessLog.MaxBytes < 0 {
+		return fmt.Errorf("access log max bytes must not be negative")
+	}
+
+	if accessLog.RotateInterval < 0 {
+		return fmt.Errorf("access log rotate interval must not be negative")
+	}
+
+	return nil
+}
+
+func validateCache(cache *CacheConfig) error {
+	switch cache.Backend {
+	case "", CacheBackendMemory:
+	case CacheBackendDisk:
+		if cache.Enabled && cache.Dir == "" {
+			return fmt.Errorf("cache directory is required for the disk backend")
+		}
+	default:
+		return fmt.Errorf("invalid cache backend: %s", cache.Backend)
+	}
+
+	if cache.MaxBytes < 0 || cache.MaxEntryBytes < 0 {
+		return fmt.Errorf("cache size limits must not be negative")
+	}
+
+	if cache.MaxBytes > 0 && cache.MaxEntryBytes > cache.MaxBytes {
+		return fmt.Errorf("cache max entry bytes exceeds max bytes")
+	}
+
+	return nil
+}
+
+func validateRetry(retry *RetryConfig) error {
+	if retry.MaxAttempts < 0 {
+		return fmt.Errorf("retry max attempts must not be negative")
+	}
+
+	if retry.InitialBackoff < 0 || retry.MaxBackoff < 0 || retry.Budget < 0 {
+		return fmt.Errorf("retry durations must not be negative")
+	}
+
+	if retry.MaxBackoff > 0 && retry.InitialBackoff > retry.MaxBackoff {
+		return fmt.Errorf("retry initial backoff exceeds max backoff")
+	}
+
+	if retry.MaxBodyBytes < 0 {
+		return fmt.Errorf("retry max body bytes must not be negative")
+	}
+
+	for _, code := range retry.StatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid retry status code: %d", code)
+		}
+	}
+
+	return nil
+}
+
+func validateForward(forward *ForwardConfig) error {
+	if forward.Enabled && len(forward.AllowedHosts) == 0 {
+		return fmt.Errorf("forward proxy mode requires allowed hosts")
+	}
+
+	for _, pattern := range append(append([]string(nil), forward.AllowedHosts...), forward.DeniedHosts...) {
+		if _, _, err := ParseHostPattern(pattern); err != nil {
+			return err
+		}
+	}
+
+	for _, port := range forward.AllowedPorts {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid forward proxy port: %d", port)
+		}
+	}
+
+	if forward.TunnelIdleTimeout < 0 {
+		return fmt.Errorf("tunnel idle timeout must not be negative")
+	}
+
+	return nil
+}
+
+var headerVariablePattern = regexp.MustCompile(`\$\{(\w+)\}`)
+
+func validateHeaderRules(rules *HeaderRulesConfig) error {
+	for i, rule := range rules.Request {
+		if err := validateHeaderRule(rule); err != nil {
+			return fmt.Errorf("request header rule %d: %w", i, err)
+		}
+	}
+
+	for i, rule := range rules.Response {
+		if err := validateHeaderRule(rule); err != nil {
+			return fmt.Errorf("response header rule %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func validateHeaderRule(rule HeaderRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("header name is required")
+	}
+
+	switch rule.Action {
+	case HeaderActionAdd, HeaderActionSet, HeaderActionRemove:
+	case HeaderActionReplace:
+		if rule.Pattern == "" {
+			return fmt.Errorf("replace requires a pattern")
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", rule.Pattern, err)
+		}
+	default:
+		return fmt.Errorf("invalid action: %s", rule.Action)
+	}
+
+	for _, match := range headerVariablePattern.FindAllStringSubmatch(rule.Value, -1) {
+		// ${1} and the like refer to capture groups in a replacement.
+		if _, err := strconv.Atoi(match[1]); err == nil && rule.Action == HeaderActionReplace {
+			continue
+		}
+		if !slices.Contains(HeaderVariables, match[1]) {
+			return fmt.Errorf("unknown variable %s", match[0])
+		}
+	}
+
+	return nil
+}
+
+func validateRewrite(rewrite *RewriteConfig) error {
+	if rewrite.PublicURL != "" {
+		u, err := url.Parse(rewrite.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid rewrite public URL: %s", rewrite.PublicURL)
+		}
+		if u.Path != "" && u.Path != "/" || u.RawQuery != "" {
+			return fmt.Errorf("rewrite public URL must be an origin without a path: %s", rewrite.PublicURL)
+		}
+	}
+
+	for _, contentType := range rewrite.ContentTypes {
+		if contentType == "" {
+			return fmt.Errorf("rewrite content types must not be empty")
+		}
+	}
+
+	return nil
+}
+
+func validateForwardedHeaders(headers *ForwardedHeadersConfig) error {
+	switch headers.Mode {
+	case "", ForwardedHeadersXForwarded, ForwardedHeadersRFC7239, ForwardedHeadersBoth, ForwardedHeadersNone:
+	default:
+		return fmt.Errorf("invalid forwarded headers mode: %s", headers.Mode)
+	}
+
+	for _, proxy := range headers.TrustedProxies {
+		if _, err := ParseTrustedProxy(proxy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateAuth(auth *AuthConfig, clientCerts *ClientCertConfig) error {
+	if auth.Enabled && len(auth.APIKeys) == 0 && auth.HtpasswdFile == "" && !clientCerts.Enabled() {
+		return fmt.Errorf("authentication requires API keys, an htpasswd file or client certificates")
+	}
+
+	keys := make(map[string]bool)
+	for i, key := range auth.APIKeys {
+		if key.Client == "" || key.Key == "" {
+			return fmt.Errorf("API key %d: client and key are required", i)
+		}
+		if keys[key.Key] {
+			return fmt.Errorf("API key %d: duplicate key for client %s", i, key.Client)
+		}
+		keys[key.Key] = true
+	}
+
+	return nil
+}
+
+func validateRateLimit(limit *RateLimitConfig) error {
+	switch limit.Key {
+	case "", RateLimitKeyAPIKey, RateLimitKeyIP, RateLimitKeyRoute:
+	default:
+		return fmt.Errorf("invalid rate limit key: %s", limit.Key)
+	}
+
+	if limit.Enabled && limit.RequestsPerSecond <= 0 && limit.Upstream.RequestsPerSecond <= 0 {
+		return fmt.Errorf("rate limiting requires requests per second for clients or upstream hosts")
+	}
+
+	if limit.RequestsPerSecond < 0 || limit.Upstream.RequestsPerSecond < 0 {
+		return fmt.Errorf("rate limit requests per second must not be negative")
+	}
+
+	if limit.Burst < 0 || limit.Upstream.Burst < 0 {
+		return fmt.Errorf("rate limit burst must not be negative")
+	}
+
+	if limit.MaxWait < 0 || limit.Upstream.MaxWait < 0 {
+		return fmt.Errorf("rate limit max wait must not be negative")
+	}
+
+	return nil
+}
+
+func validateRecording(recording *RecordingConfig) error {
+	if recording.MaxBodyBytes < 0 {
+		return fmt.Errorf("recording max body bytes must not be negative")
+	}
+
+	for _, pattern := range recording.RedactPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid recording redact pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+func validateTracing(tracing *TracingConfig) error {
+	if ratio := tracing.SampleRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+		return fmt.Errorf("tracing sample ratio must be between 0 and 1")
+	}
+
+	if !tracing.Enabled {
+		return nil
+	}
+
+	switch tracing.Exporter {
+	case "", TracingExporterOTLP:
+		if tracing.Endpoint == "" {
+			return fmt.Errorf("tracing endpoint is required for the OTLP exporter")
+		}
+		u, err := url.Parse(tracing.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid tracing endpoint: %s", tracing.Endpoint)
+		}
+	case TracingExporterStdout:
+	case TracingExporterFile:
+		if tracing.File == "" {
+			return fmt.Errorf("tracing file is required for the file exporter")
+		}
+	default:
+		return fmt.Errorf("invalid tracing exporter: %s", tracing.Exporter)
+	}
+
+	return nil
+}
+
+// ParseHostPattern splits a forward proxy host pattern such as
+// "*.example.com:443" into its lower-cased host part and port. A port of 0
+// means the pattern has no port and -1 that it explicitly allows any port
+// ("host:*").
+func ParseHostPattern(pattern string) (string, int, error) {
+	host, port := pattern, 0
+	if i := strings.LastIndex(pattern, ":"); i >= 0 && !strings.HasSuffix(pattern, "]") {
+		host = pattern[:i]
+		portStr := pattern[i+1:]
+		if portStr == "*" {
+			port = -1
+		} else {
+			p, err := strconv.Atoi(portStr)
+			if err != nil || p <= 0 || p > 65535 {
+				return "", 0, fmt.Errorf("invalid port in host pattern: %s", pattern)
+			}
+			port = p
+		}
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	if host == "" {
+		return "", 0, fmt.Errorf("empty host pattern: %q", pattern)
+	}
+	if strings.Contains(strings.TrimPrefix(host, "*."), "*") && host != "*" {
+		return "", 0, fmt.Errorf("wildcards are only allowed as a leading \"*.\": %s", pattern)
+	}
+
+	return host, port, nil
+}
+
+// ParseSPKIPin decodes a public key pin such as "sha256/<base64>", the
+// SHA-256 hash of a certificate's SubjectPublicKeyInfo.
+func ParseSPKIPin(s string) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(s, "sha256/")
+	if !ok {
+		return nil, fmt.Errorf("invalid pinned key %q: must start with sha256/", s)
+	}
+	hash, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("invalid pinned key %q: must be a base64 SHA-256 hash", s)
+	}
+	return hash, nil
+}
+
+// ParseTrustedProxy parses a trusted proxy given as a CIDR block such as
+// "10.0.0.0/8" or a single address.
+func ParseTrustedProxy(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid trusted proxy: %s", s)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid trusted proxy: %s", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ParseTLSVersion parses a minimum TLS version such as "1.2". An empty
+// string means TLS 1.2. Versions below 1.2 are refused as insecure.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	case "1.0", "1.1":
+		return 0, fmt.Errorf("TLS version %s is insecure, use 1.2 or 1.3", s)
+	}
+	return 0, fmt.Errorf("invalid TLS version: %s", s)
+}
+
+// ParseCipherSuites looks up cipher suites by their crypto/tls names, such
+// as "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Suites with known weaknesses
+// are refused. An empty list means the Go defaults.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// UpstreamList returns the configured upstream proxies, treating the legacy
+// single url/username/password fields as a one-entry list.
+func (p *ProxyConfig) UpstreamList() []UpstreamConfig {
+	if len(p.Upstreams) > 0 {
+		return p.Upstreams
+	}
+	if p.URL == "" {
+		return nil
+	}
+	return []UpstreamConfig{{
+		URL:      p.URL,
+		Username: p.Username,
+		Password: p.Password,
+	}}
+}
+
+func validateRoute(route RouteConfig) error {
+	if route.Name == "" {
+		return fmt.Errorf("route name is required")
+	}
+
+	if route.Name == DefaultRouteName {
+		return fmt.Errorf("route name %q is reserved", DefaultRouteName)
+	}
+
+	if route.Host == "" && route.PathPrefix == "" {
+		return fmt.Errorf("route must match on host or path prefix")
+	}
+
+	if route.PathPrefix != "" && !strings.HasPrefix(route.PathPrefix, "/") {
+		return fmt.Errorf("path prefix must start with /: %s", route.PathPrefix)
+	}
+
+	if route.RewritePrefix != "" && !strings.HasPrefix(route.RewritePrefix, "/") {
+		return fmt.Errorf("rewrite prefix must start with /: %s", route.RewritePrefix)
+	}
+
+	if (route.StripPrefix || route.RewritePrefix != "") && route.PathPrefix == "" {
+		return fmt.Errorf("path rewriting requires a path prefix")
+	}
+
+	if route.Target.Host == "" {
+		return fmt.Errorf("target host is required")
+	}
+
+	if route.Target.Scheme != "http" && route.Target.Scheme != "https" {
+		return fmt.Errorf("invalid target scheme: %s", route.Target.Scheme)
+	}
+
+	if err := validateTargetTLS(&route.Target); err != nil {
+		return err
+	}
+
+	if err := validateHeaderRules(&route.Headers); err != nil {
+		return err
+	}
+
+	if err := validateRewrite(&route.Rewrite); err != nil {
+		return err
+	}
+
+	return validateStreaming(&route.Streaming)
+}
+
 func DefaultConfig() *Config {
 	return &Config{
 		Server: ServerConfig{
@@ -141,4 +1206,4 @@ func DefaultConfig() *Config {
 			Format: "json",
 		},
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// WatchFile polls path every interval and calls onChange when its
+// modification time or size changes, until ctx is done.
+func WatchFile(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+
+	lastMod, lastSize := stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mod, size := stat()
+			if size < 0 || (mod.Equal(lastMod) && size == lastSize) {
+				continue
+			}
+			lastMod, lastSize = mod, size
+			onChange()
+		}
+	}
+}
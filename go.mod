@@ -1,3 +1,8 @@
 module proxy
 
 go 1.24.6
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	golang.org/x/crypto v0.40.0
+)
@@ -1,16 +1,46 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/crypto/bcrypt"
 
 	"proxy/config"
 	"proxy/logging"
 	"proxy/proxy"
+	"proxy/recording"
+	"proxy/tlsutil"
 )
 
 func TestProxyServiceIntegration(t *testing.T) {
@@ -112,6 +142,51 @@ func TestProxyServiceIntegration(t *testing.T) {
 			t.Errorf("Expected content-type application/json, got %s", resp.Header.Get("Content-Type"))
 		}
 	})
+
+	t.Run("Prometheus metrics", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", server.URL+"/metrics", nil)
+		req.Header.Set("Accept", "text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Metrics request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+			t.Errorf("Expected text/plain content-type, got %s", resp.Header.Get("Content-Type"))
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		for _, want := range []string{
+			`proxy_requests_total{method="GET",status="502",route="default"} 1`,
+			`# TYPE proxy_upstream_duration_seconds histogram`,
+			`proxy_upstream_duration_seconds_count{route="default"} 1`,
+			`proxy_requests_in_flight 0`,
+		} {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("Expected metrics to contain %q, got:\n%s", want, body)
+			}
+		}
+	})
+
+	t.Run("JSON metrics", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/metrics")
+		if err != nil {
+			t.Fatalf("Metrics request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var payload struct {
+			Metrics map[string]interface{} `json:"metrics"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+			t.Fatalf("Failed to decode metrics: %v", err)
+		}
+
+		if payload.Metrics["requests_total"] != float64(1) {
+			t.Errorf("Expected requests_total 1, got %v", payload.Metrics["requests_total"])
+		}
+	})
 }
 
 func TestConfigValidationInHandler(t *testing.T) {
@@ -168,4 +243,2945 @@ func TestConfigValidationInHandler(t *testing.T) {
 			t.Errorf("Expected error for invalid proxy URL")
 		}
 	})
-}
\ No newline at end of file
+}
+// newTestUpstreamProxy starts a minimal HTTP forward proxy that plays the
+// role of the third-party proxy service in tests.
+func newTestUpstreamProxy(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") == "" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		if r.Method == http.MethodConnect {
+			targetConn, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			clientConn, _, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				targetConn.Close()
+				return
+			}
+			clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+			go func() {
+				io.Copy(targetConn, clientConn)
+				targetConn.Close()
+			}()
+			io.Copy(clientConn, targetConn)
+			clientConn.Close()
+			return
+		}
+
+		outReq, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		outReq.Header = r.Header.Clone()
+		outReq.Header.Del("Proxy-Authorization")
+		outReq.Trailer = r.Trailer
+
+		// Pass 1xx responses such as 103 Early Hints straight through.
+		outReq = outReq.WithContext(httptrace.WithClientTrace(outReq.Context(), &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code != http.StatusContinue {
+					for name, values := range header {
+						w.Header()[name] = values
+					}
+					w.WriteHeader(code)
+					clear(w.Header())
+				}
+				return nil
+			},
+		}))
+
+		resp, err := http.DefaultTransport.RoundTrip(outReq)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		for name := range resp.Trailer {
+			w.Header().Add("Trailer", name)
+		}
+		w.WriteHeader(resp.StatusCode)
+
+		// Relay bytes as they arrive, as real proxy services do, so that
+		// streamed responses reach the proxy under test.
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				break
+			}
+		}
+		for name, values := range resp.Trailer {
+			w.Header()[name] = values
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	return upstream
+}
+
+func TestRoutingTable(t *testing.T) {
+	newTarget := func(name string) *httptest.Server {
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Target", name)
+			w.Header().Set("X-Path", r.URL.Path)
+		}))
+		t.Cleanup(target.Close)
+		return target
+	}
+
+	defaultTarget := newTarget("default")
+	apiTarget := newTarget("api")
+	vendorTarget := newTarget("vendor")
+	upstream := newTestUpstreamProxy(t)
+
+	cfg := config.DefaultConfig()
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: defaultTarget.Listener.Addr().String()}
+	cfg.Proxy.URL = upstream.URL
+	cfg.Routes = []config.RouteConfig{
+		{
+			Name:          "api",
+			PathPrefix:    "/api",
+			RewritePrefix: "/v2",
+			Target:        config.TargetConfig{Scheme: "http", Host: apiTarget.Listener.Addr().String()},
+		},
+		{
+			Name:        "vendor",
+			Host:        "*.vendor.test",
+			PathPrefix:  "/static/",
+			StripPrefix: true,
+			Target:      config.TargetConfig{Scheme: "http", Host: vendorTarget.Listener.Addr().String()},
+		},
+	}
+
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(io.Discard)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler.ServeHTTP))
+	defer server.Close()
+
+	tests := []struct {
+		host, path, wantTarget, wantPath string
+	}{
+		{"", "/page", "default", "/page"},
+		{"", "/api/users", "api", "/v2/users"},
+		{"", "/apiary", "default", "/apiary"},
+		{"cdn.vendor.test", "/static/app.js", "vendor", "/app.js"},
+		{"other.test", "/static/app.js", "default", "/static/app.js"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", server.URL+tt.path, nil)
+		if tt.host != "" {
+			req.Host = tt.host
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request to %s%s failed: %v", tt.host, tt.path, err)
+		}
+		resp.Body.Close()
+
+		if got := resp.Header.Get("X-Target"); got != tt.wantTarget {
+			t.Errorf("%s%s: expected target %s, got %s", tt.host, tt.path, tt.wantTarget, got)
+		}
+		if got := resp.Header.Get("X-Path"); got != tt.wantPath {
+			t.Errorf("%s%s: expected path %s, got %s", tt.host, tt.path, tt.wantPath, got)
+		}
+	}
+}
+
+func TestUpstreamProxyFailover(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+
+	// Reserve a port and release it so connections to it are refused.
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL := dead.URL
+	dead.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: target.Listener.Addr().String()}
+	cfg.Proxy = config.ProxyConfig{
+		Strategy:    config.StrategyRoundRobin,
+		MaxFailures: 1,
+		Upstreams: []config.UpstreamConfig{
+			{URL: deadURL, Username: "user", Password: "pass"},
+			{URL: upstream.URL, Username: "user", Password: "pass"},
+		},
+	}
+
+	var logBuffer bytes.Buffer
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(&logBuffer)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler.ServeHTTP))
+	defer server.Close()
+
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(server.URL + "/")
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Request %d: expected status 200, got %d", i, resp.StatusCode)
+		}
+	}
+
+	if !bytes.Contains(logBuffer.Bytes(), []byte("Upstream proxy marked unhealthy")) {
+		t.Errorf("Expected dead upstream to be marked unhealthy, logs: %s", logBuffer.String())
+	}
+}
+
+func TestResponseCaching(t *testing.T) {
+	var hits, revalidations int
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("fresh body"))
+		case "/revalidate":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				revalidations++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("revalidated body"))
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+			w.Write([]byte("private body"))
+		case "/ranged":
+			w.Header().Set("Cache-Control", "max-age=60")
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader("full ranged body"))
+		}
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+
+	cfg := config.DefaultConfig()
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: target.Listener.Addr().String()}
+	cfg.Proxy.URL = upstream.URL
+	cfg.Cache = config.CacheConfig{Enabled: true, MaxBytes: 1 << 20}
+
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(io.Discard)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler.ServeHTTP))
+	defer server.Close()
+
+	get := func(path string) (string, string) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.Header.Get("X-Cache"), string(body)
+	}
+
+	tests := []struct {
+		path, wantCache, wantBody string
+		wantHits                  int
+	}{
+		{"/fresh", "MISS", "fresh body", 1},
+		{"/fresh", "HIT", "fresh body", 1},
+		{"/revalidate", "MISS", "revalidated body", 2},
+		{"/revalidate", "REVALIDATED", "revalidated body", 3},
+		{"/private", "MISS", "private body", 4},
+		{"/private", "MISS", "private body", 5},
+	}
+
+	for _, tt := range tests {
+		cacheStatus, body := get(tt.path)
+		if cacheStatus != tt.wantCache {
+			t.Errorf("%s: expected X-Cache %s, got %s", tt.path, tt.wantCache, cacheStatus)
+		}
+		if body != tt.wantBody {
+			t.Errorf("%s: expected body %q, got %q", tt.path, tt.wantBody, body)
+		}
+		if hits != tt.wantHits {
+			t.Errorf("%s: expected %d target hits, got %d", tt.path, tt.wantHits, hits)
+		}
+	}
+
+	if revalidations != 1 {
+		t.Errorf("Expected 1 conditional revalidation, got %d", revalidations)
+	}
+
+	t.Run("Ranged requests bypass the cache", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/ranged", nil)
+		req.Header.Set("Range", "bytes=0-3")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Ranged request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent || string(body) != "full" {
+			t.Fatalf("Expected 206 with the first 4 bytes, got %d %q", resp.StatusCode, body)
+		}
+
+		cacheStatus, body2 := get("/ranged")
+		if cacheStatus != "MISS" || body2 != "full ranged body" {
+			t.Errorf("Expected the full body from the target, got X-Cache %s and %q", cacheStatus, body2)
+		}
+	})
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	var attempts int
+	var bodies []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if attempts < 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+
+	cfg := config.DefaultConfig()
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: target.Listener.Addr().String()}
+	cfg.Proxy.URL = upstream.URL
+	cfg.Retry = config.RetryConfig{
+		MaxAttempts:    3,
+		Methods:        []string{"PUT"},
+		StatusCodes:    []int{http.StatusTooManyRequests},
+		InitialBackoff: config.Duration(time.Millisecond),
+		MaxBackoff:     config.Duration(5 * time.Millisecond),
+	}
+	cfg.Logging.Level = "debug"
+
+	var logBuffer bytes.Buffer
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(&logBuffer)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler.ServeHTTP))
+	defer server.Close()
+
+	req, _ := http.NewRequest("PUT", server.URL+"/upload", strings.NewReader("payload"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 after retries, got %d", resp.StatusCode)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+	for i, body := range bodies {
+		if body != "payload" {
+			t.Errorf("Attempt %d: expected replayed body 'payload', got %q", i+1, body)
+		}
+	}
+	if !strings.Contains(logBuffer.String(), `"attempt":2`) {
+		t.Errorf("Expected attempts to be logged with their number, logs: %s", logBuffer.String())
+	}
+
+	t.Run("Single upstream retries by default", func(t *testing.T) {
+		attempts = 0
+		bodies = nil
+
+		cfg := config.DefaultConfig()
+		cfg.Target = config.TargetConfig{Scheme: "http", Host: target.Listener.Addr().String()}
+		cfg.Proxy.URL = upstream.URL
+		cfg.Retry = config.RetryConfig{
+			StatusCodes:    []int{http.StatusTooManyRequests},
+			InitialBackoff: config.Duration(time.Millisecond),
+			MaxBackoff:     config.Duration(5 * time.Millisecond),
+		}
+
+		logger := logging.NewLogger(&cfg.Logging)
+		logger.SetOutput(io.Discard)
+		handler, err := proxy.NewHandler(cfg, logger)
+		if err != nil {
+			t.Fatalf("Failed to create handler: %v", err)
+		}
+		server := httptest.NewServer(http.HandlerFunc(handler.ServeHTTP))
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + "/download")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || attempts != 3 {
+			t.Errorf("Expected 3 attempts ending in 200, got %d attempts and status %d", attempts, resp.StatusCode)
+		}
+	})
+
+	t.Run("Non-idempotent methods are not retried", func(t *testing.T) {
+		attempts = 0
+		resp, err := http.Post(server.URL+"/submit", "text/plain", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusTooManyRequests || attempts != 1 {
+			t.Errorf("Expected a single attempt returning 429, got %d attempts and status %d", attempts, resp.StatusCode)
+		}
+	})
+}
+
+func TestConnectTunnel(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret " + r.URL.Path))
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+	_, targetPort, _ := net.SplitHostPort(target.Listener.Addr().String())
+	port, _ := strconv.Atoi(targetPort)
+
+	cfg := config.DefaultConfig()
+	cfg.Proxy.URL = upstream.URL
+	cfg.Forward = config.ForwardConfig{
+		Enabled:      true,
+		AllowedHosts: []string{"127.0.0.1"},
+		AllowedPorts: []int{port},
+	}
+
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(io.Discard)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler.ServeHTTP)
+	server := httptest.NewServer(handler.ForwardProxy(mux))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(serverURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get(target.URL + "/tunnelled")
+	if err != nil {
+		t.Fatalf("Request through tunnel failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "secret /tunnelled" {
+		t.Errorf("Expected body from target, got %q", body)
+	}
+
+	t.Run("Disallowed port is rejected", func(t *testing.T) {
+		conn, err := net.Dial("tcp", serverURL.Host)
+		if err != nil {
+			t.Fatalf("Failed to dial proxy: %v", err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("CONNECT example.com:25 HTTP/1.1\r\nHost: example.com:25\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Failed to read CONNECT response: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestForwardProxyAbsoluteURI(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("forwarded " + r.URL.RequestURI()))
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+	_, targetPort, _ := net.SplitHostPort(target.Listener.Addr().String())
+
+	cfg := config.DefaultConfig()
+	cfg.Proxy.URL = upstream.URL
+	cfg.Forward = config.ForwardConfig{
+		Enabled:      true,
+		AllowedHosts: []string{"127.0.0.1:" + targetPort, "*.internal.test"},
+		DeniedHosts:  []string{"secret.internal.test"},
+	}
+
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(io.Discard)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", handler.HealthCheck)
+	mux.HandleFunc("/", handler.ServeHTTP)
+	server := httptest.NewServer(handler.ForwardProxy(mux))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(serverURL)}}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get(target.URL + "/health?x=1")
+	if err != nil {
+		t.Fatalf("Forward request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "forwarded /health?x=1" {
+		t.Errorf("Expected request to reach the target, got %q", body)
+	}
+
+	for _, denied := range []string{"http://example.com/", "http://secret.internal.test/", "http://api.internal.test:8080/"} {
+		resp, err := client.Get(denied)
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", denied, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: expected status 403, got %d", denied, resp.StatusCode)
+		}
+	}
+}
+
+func TestInboundAuthentication(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "" || r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswd, []byte("alice:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write htpasswd: %v", err)
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: target.Listener.Addr().String()}
+	cfg.Proxy.URL = upstream.URL
+	cfg.Forward = config.ForwardConfig{Enabled: true, AllowedHosts: []string{"127.0.0.1:*"}}
+	cfg.Auth = config.AuthConfig{
+		Enabled:      true,
+		APIKeys:      []config.APIKeyConfig{{Client: "scraper", Key: "key-123"}},
+		HtpasswdFile: htpasswd,
+	}
+
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(io.Discard)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handler.Metrics)
+	mux.HandleFunc("/", handler.ServeHTTP)
+	server := httptest.NewServer(handler.ForwardProxy(mux))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		setup      func(r *http.Request)
+		wantStatus int
+	}{
+		{"No credentials", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"Wrong API key", func(r *http.Request) { r.Header.Set("X-API-Key", "nope") }, http.StatusUnauthorized},
+		{"Valid API key", func(r *http.Request) { r.Header.Set("X-API-Key", "key-123") }, http.StatusOK},
+		{"Valid basic auth", func(r *http.Request) { r.SetBasicAuth("alice", "s3cret") }, http.StatusOK},
+		{"Wrong password", func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", server.URL+"/page", nil)
+			tt.setup(req)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("Expected WWW-Authenticate challenge")
+			}
+		})
+	}
+
+	t.Run("Forward proxy requires Proxy-Authorization", func(t *testing.T) {
+		serverURL, _ := url.Parse(server.URL)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(serverURL)}}
+		defer client.CloseIdleConnections()
+
+		resp, err := client.Get(target.URL + "/page")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("Expected status 407, got %d", resp.StatusCode)
+		}
+
+		serverURL.User = url.UserPassword("scraper", "key-123")
+		authed := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(serverURL)}}
+		defer authed.CloseIdleConnections()
+
+		resp, err = authed.Get(target.URL + "/page")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Failures are counted", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/metrics?format=prometheus")
+		if err != nil {
+			t.Fatalf("Metrics request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if !strings.Contains(string(body), `proxy_auth_failures_total{mode="reverse",reason="invalid"} 2`) {
+			t.Errorf("Expected invalid credential failures to be counted, got:\n%s", body)
+		}
+	})
+}
+
+func TestRateLimiting(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+
+	newServer := func(limit config.RateLimitConfig) *httptest.Server {
+		cfg := config.DefaultConfig()
+		cfg.Target = config.TargetConfig{Scheme: "http", Host: target.Listener.Addr().String()}
+		cfg.Proxy.URL = upstream.URL
+		cfg.RateLimit = limit
+
+		logger := logging.NewLogger(&cfg.Logging)
+		logger.SetOutput(io.Discard)
+		handler, err := proxy.NewHandler(cfg, logger)
+		if err != nil {
+			t.Fatalf("Failed to create handler: %v", err)
+		}
+
+		server := httptest.NewServer(http.HandlerFunc(handler.ServeHTTP))
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	t.Run("Per-client limit rejects bursts", func(t *testing.T) {
+		server := newServer(config.RateLimitConfig{
+			Enabled:           true,
+			Key:               config.RateLimitKeyIP,
+			RequestsPerSecond: 0.5,
+			Burst:             2,
+		})
+
+		var statuses []int
+		var retryAfter string
+		for i := 0; i < 3; i++ {
+			resp, err := http.Get(server.URL + "/")
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+			statuses = append(statuses, resp.StatusCode)
+			retryAfter = resp.Header.Get("Retry-After")
+		}
+
+		if statuses[0] != http.StatusOK || statuses[1] != http.StatusOK || statuses[2] != http.StatusTooManyRequests {
+			t.Errorf("Expected statuses [200 200 429], got %v", statuses)
+		}
+		if retryAfter != "2" {
+			t.Errorf("Expected Retry-After 2, got %q", retryAfter)
+		}
+	})
+
+	t.Run("Upstream limit queues within max wait", func(t *testing.T) {
+		server := newServer(config.RateLimitConfig{
+			Enabled: true,
+			Upstream: config.UpstreamRateLimitConfig{
+				RequestsPerSecond: 20,
+				Burst:             1,
+				MaxWait:           config.Duration(time.Second),
+			},
+		})
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			resp, err := http.Get(server.URL + "/")
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Request %d: expected status 200, got %d", i, resp.StatusCode)
+			}
+		}
+
+		if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+			t.Errorf("Expected queued requests to be spaced out, took only %v", elapsed)
+		}
+	})
+}
+
+func TestConfigReload(t *testing.T) {
+	newTarget := func(body string) *httptest.Server {
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(target.Close)
+		return target
+	}
+	first := newTarget("first")
+	second := newTarget("second")
+
+	upstream := newTestUpstreamProxy(t)
+
+	cfg := config.DefaultConfig()
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: first.Listener.Addr().String()}
+	cfg.Proxy.URL = upstream.URL
+
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(io.Discard)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler.ServeHTTP))
+	defer server.Close()
+
+	get := func() string {
+		resp, err := http.Get(server.URL + "/")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if body := get(); body != "first" {
+		t.Fatalf("Expected response from first target, got %q", body)
+	}
+
+	t.Run("Target is swapped", func(t *testing.T) {
+		next := *cfg
+		next.Target = config.TargetConfig{Scheme: "http", Host: second.Listener.Addr().String()}
+		if err := handler.Reload(&next); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+
+		if body := get(); body != "second" {
+			t.Errorf("Expected response from second target, got %q", body)
+		}
+	})
+
+	t.Run("Failed reload keeps current config", func(t *testing.T) {
+		current := handler.Config()
+
+		next := *current
+		next.Auth = config.AuthConfig{
+			Enabled:      true,
+			HtpasswdFile: filepath.Join(t.TempDir(), "missing"),
+		}
+		if err := handler.Reload(&next); err == nil {
+			t.Fatal("Expected reload with a missing htpasswd file to fail")
+		}
+
+		if handler.Config() != current {
+			t.Error("Expected the previous configuration to stay active")
+		}
+		if body := get(); body != "second" {
+			t.Errorf("Expected response from second target, got %q", body)
+		}
+	})
+
+	t.Run("Client certificate settings need a restart", func(t *testing.T) {
+		current := handler.Config()
+
+		next := *current
+		next.Server.TLS.ClientCerts = config.ClientCertConfig{Mode: config.ClientCertRequire, CAFile: "ca.pem"}
+		if err := handler.Reload(&next); err == nil {
+			t.Fatal("Expected reload with new client certificate settings to fail")
+		}
+		if handler.Config() != current {
+			t.Error("Expected the previous configuration to stay active")
+		}
+	})
+
+	t.Run("File changes are detected", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		changed := make(chan struct{}, 1)
+		go config.WatchFile(ctx, path, 10*time.Millisecond, func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+
+		time.Sleep(30 * time.Millisecond)
+		if err := os.WriteFile(path, []byte(`{"server":{}}`), 0644); err != nil {
+			t.Fatalf("Failed to rewrite config: %v", err)
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+			t.Error("Expected the change to be detected")
+		}
+	})
+}
+
+func TestRecordingAndReplay(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cached" {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Location", "http://"+r.Host+"/elsewhere")
+			w.Write([]byte("cached body"))
+			return
+		}
+		if r.URL.Path == "/compressed" {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			zw.Write([]byte(strings.Repeat("compressed text ", 100)))
+			zw.Close()
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.Write([]byte("echo:" + string(body) + ":" + r.URL.Query().Get("q")))
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+	file := filepath.Join(t.TempDir(), "recordings.jsonl")
+
+	cfg := config.DefaultConfig()
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: target.Listener.Addr().String()}
+	cfg.Proxy.URL = upstream.URL
+	cfg.Recording = config.RecordingConfig{
+		Enabled:        true,
+		File:           file,
+		MaxBodyBytes:   16,
+		RedactHeaders:  []string{"X-Secret"},
+		RedactQuery:    []string{"token"},
+		RedactPatterns: []string{`card=\d+`},
+	}
+
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(io.Discard)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler.ServeHTTP))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/data?q=1&token=s3cret", strings.NewReader("card=4111 and more padding"))
+	req.Header.Set("X-Secret", "hunter2")
+	req.Header.Set("X-API-Key", "key-1234")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Failed to read recording: %v", err)
+	}
+	for _, secret := range []string{"hunter2", "key-1234", "s3cret", "4111", "session=abc"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("Expected %q to be redacted, got:\n%s", secret, data)
+		}
+	}
+
+	exchanges, err := recording.Load(file)
+	if err != nil {
+		t.Fatalf("Failed to load recording: %v", err)
+	}
+	if len(exchanges) != 1 {
+		t.Fatalf("Expected 1 recorded exchange, got %d", len(exchanges))
+	}
+	exchange := exchanges[0]
+	if exchange.Request.Method != http.MethodPost || exchange.Response.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected exchange: %+v", exchange)
+	}
+	if !exchange.Request.BodyTruncated || exchange.Request.Body != "[REDACTED] and mo" {
+		t.Errorf("Expected request body truncated to 16 bytes and redacted, got %q", exchange.Request.Body)
+	}
+
+	replay := httptest.NewServer(recording.NewReplayer(exchanges))
+	defer replay.Close()
+
+	t.Run("Recorded response is replayed", func(t *testing.T) {
+		resp, err := http.Post(replay.URL+"/api/data?q=2", "text/plain", nil)
+		if err != nil {
+			t.Fatalf("Replay request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if !strings.HasPrefix(string(body), "echo:") {
+			t.Errorf("Expected recorded body, got %q", body)
+		}
+	})
+
+	t.Run("Unknown request is not found", func(t *testing.T) {
+		resp, err := http.Get(replay.URL + "/other")
+		if err != nil {
+			t.Fatalf("Replay request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Compressed response is recorded decoded", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/compressed", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		exchanges, err := recording.Load(file)
+		if err != nil {
+			t.Fatalf("Failed to load recording: %v", err)
+		}
+		exchange := exchanges[len(exchanges)-1]
+		if exchange.Response.Body != "compressed text " || !exchange.Response.BodyTruncated {
+			t.Errorf("Expected decoded body truncated to 16 bytes, got %q", exchange.Response.Body)
+		}
+		if encoding := exchange.Response.Header.Get("Content-Encoding"); encoding != "" {
+			t.Errorf("Expected Content-Encoding to be dropped, got %q", encoding)
+		}
+
+		replay := httptest.NewServer(recording.NewReplayer(exchanges))
+		defer replay.Close()
+		resp, err = http.Get(replay.URL + "/compressed")
+		if err != nil {
+			t.Fatalf("Replay request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || string(body) != "compressed text " {
+			t.Errorf("Expected decoded body on replay, got %d %q", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("Cache hits record what a miss records", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "recordings.jsonl")
+		cached := *cfg
+		cached.Recording.File = file
+		cached.Cache = config.CacheConfig{Enabled: true, MaxBytes: 1 << 20}
+		cached.Rewrite.Enabled = true
+		handler, err := proxy.NewHandler(&cached, logger)
+		if err != nil {
+			t.Fatalf("Failed to create handler: %v", err)
+		}
+		server := httptest.NewServer(http.HandlerFunc(handler.ServeHTTP))
+		defer server.Close()
+
+		var cacheStatuses []string
+		for i := 0; i < 2; i++ {
+			resp, err := http.Get(server.URL + "/cached")
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			cacheStatuses = append(cacheStatuses, resp.Header.Get("X-Cache"))
+		}
+		handler.Shutdown(context.Background())
+		if cacheStatuses[0] != "MISS" || cacheStatuses[1] != "HIT" {
+			t.Fatalf("Expected a miss then a hit, got %v", cacheStatuses)
+		}
+
+		exchanges, err := recording.Load(file)
+		if err != nil || len(exchanges) != 2 {
+			t.Fatalf("Expected 2 recorded exchanges, got %d (%v)", len(exchanges), err)
+		}
+		miss, hit := exchanges[0].Response, exchanges[1].Response
+		if !reflect.DeepEqual(miss.Header, hit.Header) || miss.Body != hit.Body {
+			t.Errorf("Expected the hit to record the same response as the miss:\nmiss: %v %q\nhit:  %v %q", miss.Header, miss.Body, hit.Header, hit.Body)
+		}
+	})
+}
+
+func TestAccessLog(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+
+	run := func(t *testing.T, format string) string {
+		path := filepath.Join(t.TempDir(), "access.log")
+
+		cfg := config.DefaultConfig()
+		cfg.Target = config.TargetConfig{Scheme: "http", Host: target.Listener.Addr().String()}
+		cfg.Proxy.URL = upstream.URL
+		cfg.AccessLog = config.AccessLogConfig{Enabled: true, File: path, Format: format}
+
+		logger := logging.NewLogger(&cfg.Logging)
+		logger.SetOutput(io.Discard)
+		handler, err := proxy.NewHandler(cfg, logger)
+		if err != nil {
+			t.Fatalf("Failed to create handler: %v", err)
+		}
+
+		server := httptest.NewServer(handler.AccessLog(http.HandlerFunc(handler.ServeHTTP)))
+		defer server.Close()
+
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/page?x=1", nil)
+		req.Header.Set("User-Agent", `test "agent"`)
+		req.Header.Set("Referer", "http://example.com/")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read access log: %v", err)
+		}
+		return string(data)
+	}
+
+	t.Run("Combined", func(t *testing.T) {
+		line := run(t, config.AccessLogFormatCombined)
+		if !strings.HasPrefix(line, "127.0.0.1 - - [") {
+			t.Errorf("Unexpected combined log prefix: %q", line)
+		}
+		if !strings.Contains(line, `] "GET /page?x=1 HTTP/1.1" 201 5 "http://example.com/" "test \"agent\""`) {
+			t.Errorf("Unexpected combined log line: %q", line)
+		}
+	})
+
+	t.Run("W3C", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(run(t, config.AccessLogFormatW3C)), "\n")
+		if len(lines) != 3 || !strings.HasPrefix(lines[1], "#Fields: date time c-ip") {
+			t.Fatalf("Expected W3C header and one entry, got %q", lines)
+		}
+		fields := strings.Fields(lines[2])
+		if len(fields) != 13 || fields[5] != "/page" || fields[6] != "x=1" || fields[7] != "201" {
+			t.Errorf("Unexpected W3C entry: %q", lines[2])
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(run(t, config.AccessLogFormatJSON)), &entry); err != nil {
+			t.Fatalf("Access log line is not JSON: %v", err)
+		}
+		if entry["status"] != float64(201) || entry["bytes"] != float64(5) || entry["route"] != config.DefaultRouteName {
+			t.Errorf("Unexpected JSON access log entry: %v", entry)
+		}
+	})
+
+	t.Run("Reload during a slow request", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.Write([]byte("slow"))
+		}))
+		defer slow.Close()
+
+		dir := t.TempDir()
+		path := filepath.Join(dir, "access.log")
+
+		cfg := config.DefaultConfig()
+		cfg.Target = config.TargetConfig{Scheme: "http", Host: slow.Listener.Addr().String()}
+		cfg.Proxy.URL = upstream.URL
+		cfg.AccessLog = config.AccessLogConfig{Enabled: true, File: path}
+
+		logger := logging.NewLogger(&cfg.Logging)
+		logger.SetOutput(io.Discard)
+		handler, err := proxy.NewHandler(cfg, logger)
+		if err != nil {
+			t.Fatalf("Failed to create handler: %v", err)
+		}
+		defer handler.Shutdown(context.Background())
+
+		server := httptest.NewServer(handler.AccessLog(http.HandlerFunc(handler.ServeHTTP)))
+		defer server.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			resp, err := http.Get(server.URL + "/slow")
+			if err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			done <- err
+		}()
+		<-started
+
+		next := *cfg
+		next.AccessLog.File = filepath.Join(dir, "next.log")
+		if err := handler.Reload(&next); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+
+		close(release)
+		if err := <-done; err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+
+		data, _ := os.ReadFile(path)
+		if !strings.Contains(string(data), `"GET /slow HTTP/1.1" 200 4`) {
+			t.Errorf("Expected the slow request in the old access log, got %q", data)
+		}
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "upstream-echo")
+		w.Write([]byte(r.Header.Get("X-Request-ID")))
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+
+	cfg := config.DefaultConfig()
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: target.Listener.Addr().String()}
+	cfg.Proxy.URL = upstream.URL
+	cfg.Auth = config.AuthConfig{
+		Enabled: true,
+		APIKeys: []config.APIKeyConfig{{Client: "tester", Key: "secret"}},
+	}
+
+	var logs safeBuffer
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(&logs)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler.ServeHTTP))
+	defer server.Close()
+
+	get := func(id, key string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	t.Run("Incoming ID is honoured and forwarded", func(t *testing.T) {
+		resp, body := get("client-id-123", "secret")
+		if got := resp.Header.Values("X-Request-ID"); len(got) != 1 || got[0] != "client-id-123" {
+			t.Errorf("Expected echoed request ID, got %v", got)
+		}
+		if body != "client-id-123" {
+			t.Errorf("Expected request ID forwarded upstream, got %q", body)
+		}
+	})
+
+	t.Run("Invalid ID is replaced", func(t *testing.T) {
+		resp, body := get(`bad "id"`, "secret")
+		id := resp.Header.Get("X-Request-ID")
+		if len(id) != 32 || body != id {
+			t.Errorf("Expected generated request ID forwarded upstream, got header %q body %q", id, body)
+		}
+	})
+
+	t.Run("Error body includes ID", func(t *testing.T) {
+		resp, body := get("denied-id", "")
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected status 401, got %d", resp.StatusCode)
+		}
+		var errBody map[string]string
+		if err := json.Unmarshal([]byte(body), &errBody); err != nil {
+			t.Fatalf("Error body is not JSON: %v", err)
+		}
+		if errBody["request_id"] != "denied-id" {
+			t.Errorf("Expected request ID in error body, got %q", body)
+		}
+	})
+
+	t.Run("Log entries carry ID", func(t *testing.T) {
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var entry logging.LogEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("Log line is not JSON: %q", line)
+			}
+			if entry.Fields["request_id"] == nil || entry.Fields["request_id"] == "" {
+				t.Errorf("Expected request_id in log entry %q", line)
+			}
+		}
+	})
+}
+
+// safeBuffer is a bytes.Buffer that can be written from handler goroutines
+// while a test reads it.
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTracing(t *testing.T) {
+	var received safeBuffer
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Write([]byte(r.Header.Get("Traceparent")))
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+	traceFile := filepath.Join(t.TempDir(), "traces.jsonl")
+
+	cfg := config.DefaultConfig()
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: target.Listener.Addr().String()}
+	cfg.Proxy.URL = upstream.URL
+	cfg.Tracing = config.TracingConfig{
+		Enabled:     true,
+		ServiceName: "proxy-test",
+		Exporter:    config.TracingExporterFile,
+		File:        traceFile,
+	}
+
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(io.Discard)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler.ServeHTTP))
+	defer server.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentID = "00f067aa0ba902b7"
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/traced", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	req.Header.Set("tracestate", "vendor=value")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if err := handler.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	type span struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		TraceState   string `json:"traceState"`
+		Kind         int    `json:"kind"`
+		Events       []struct {
+			Name string `json:"name"`
+		} `json:"events"`
+	}
+	var export struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []span `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	data, err := os.ReadFile(traceFile)
+	if err != nil {
+		t.Fatalf("Failed to read trace file: %v", err)
+	}
+	if err := json.Unmarshal(data, &export); err != nil {
+		t.Fatalf("Trace file is not OTLP JSON: %v\n%s", err, data)
+	}
+
+	spans := make(map[int]span)
+	for _, rs := range export.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				spans[s.Kind] = s
+			}
+		}
+	}
+	serverSpan, ok := spans[2]
+	if !ok {
+		t.Fatalf("Expected a server span, got:\n%s", data)
+	}
+	clientSpan, ok := spans[3]
+	if !ok {
+		t.Fatalf("Expected a client span, got:\n%s", data)
+	}
+
+	if serverSpan.TraceID != traceID || serverSpan.ParentSpanID != parentID || serverSpan.TraceState != "vendor=value" {
+		t.Errorf("Expected server span to continue the incoming trace, got %+v", serverSpan)
+	}
+	if clientSpan.TraceID != traceID || clientSpan.ParentSpanID != serverSpan.SpanID {
+		t.Errorf("Expected client span to be a child of the server span, got %+v", clientSpan)
+	}
+
+	events := make(map[string]bool)
+	for _, e := range clientSpan.Events {
+		events[e.Name] = true
+	}
+	if !events["proxy.dial.start"] || !events["response.first_byte"] {
+		t.Errorf("Expected dial and first byte events, got %+v", clientSpan.Events)
+	}
+
+	if want := "00-" + traceID + "-" + clientSpan.SpanID + "-01"; received.String() != want {
+		t.Errorf("Expected target to receive traceparent %q, got %q", want, received.String())
+	}
+}
+
+func TestStreamingResponses(t *testing.T) {
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		switch r.URL.Path {
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: first\n\n"))
+			flusher.Flush()
+			<-release
+			w.Write([]byte("data: second\n\n"))
+		case "/slow":
+			// Outlives the server's write timeout, but never goes quiet
+			// for longer than the streaming write timeout.
+			for i := 0; i < 10; i++ {
+				w.Write([]byte("tick\n"))
+				flusher.Flush()
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+
+	cfg := config.DefaultConfig()
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: target.Listener.Addr().String()}
+	cfg.Proxy.URL = upstream.URL
+	cfg.Streaming = config.StreamingConfig{
+		FlushInterval: config.Duration(10 * time.Millisecond),
+		WriteTimeout:  config.Duration(300 * time.Millisecond),
+	}
+
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(io.Discard)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(handler.ServeHTTP))
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	t.Run("Events are flushed as they arrive", func(t *testing.T) {
+		var once sync.Once
+		defer once.Do(func() { close(release) })
+
+		resp, err := http.Get(server.URL + "/events")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		reader := bufio.NewReader(resp.Body)
+		line, err := reader.ReadString('\n')
+		if err != nil || line != "data: first\n" {
+			t.Fatalf("Expected first event before the stream ends, got %q (%v)", line, err)
+		}
+
+		once.Do(func() { close(release) })
+		rest, _ := io.ReadAll(reader)
+		if !strings.Contains(string(rest), "data: second") {
+			t.Errorf("Expected second event, got %q", rest)
+		}
+	})
+
+	t.Run("Write deadline extends while bytes flow", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/slow")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Stream was cut off: %v", err)
+		}
+		if n := strings.Count(string(body), "tick"); n != 10 {
+			t.Errorf("Expected 10 ticks, got %d", n)
+		}
+	})
+
+	t.Run("Streams outlive the upstream timeout", func(t *testing.T) {
+		short := *cfg
+		short.Proxy.Timeout = config.Duration(150 * time.Millisecond)
+		handler, err := proxy.NewHandler(&short, logger)
+		if err != nil {
+			t.Fatalf("Failed to create handler: %v", err)
+		}
+		server := httptest.NewServer(http.HandlerFunc(handler.ServeHTTP))
+		defer server.Close()
+
+		start := time.Now()
+		resp, err := http.Get(server.URL + "/slow")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Stream was cut off after %v: %v", time.Since(start), err)
+		}
+		if n := strings.Count(string(body), "tick"); n != 10 {
+			t.Errorf("Expected 10 ticks past the timeout, got %d after %v", n, time.Since(start))
+		}
+	})
+}
+
+func TestUpgradeTunnel(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			rw.WriteString("echo: " + line)
+			rw.Flush()
+		}
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+	targetURL, _ := url.Parse(target.URL)
+
+	cfg := config.DefaultConfig()
+	cfg.Proxy.URL = upstream.URL
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: targetURL.Host}
+
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(io.Discard)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	t.Run("Switched connection is relayed both ways", func(t *testing.T) {
+		conn, err := net.Dial("tcp", serverURL.Host)
+		if err != nil {
+			t.Fatalf("Failed to dial proxy: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		conn.Write([]byte("GET /socket HTTP/1.1\r\nHost: " + serverURL.Host + "\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read upgrade response: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Expected status 101, got %d", resp.StatusCode)
+		}
+		if resp.Header.Get("Upgrade") != "echo" {
+			t.Errorf("Expected Upgrade: echo, got %q", resp.Header.Get("Upgrade"))
+		}
+		if resp.Header.Get("X-Request-Id") == "" {
+			t.Error("Expected a request ID on the 101 response")
+		}
+
+		for _, message := range []string{"hello\n", "again\n"} {
+			conn.Write([]byte(message))
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read echoed message: %v", err)
+			}
+			if line != "echo: "+message {
+				t.Errorf("Expected %q, got %q", "echo: "+message, line)
+			}
+		}
+	})
+
+	t.Run("Refused upgrade is relayed as a response", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/socket", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "other")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestTrailersAndInformational(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/trailers":
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Trailer", "X-Checksum")
+			w.Write([]byte(string(body) + " " + r.Trailer.Get("X-Request-Sum")))
+			w.Header().Set("X-Checksum", "abc123")
+		case "/upload":
+			body, _ := io.ReadAll(r.Body)
+			w.Write(body)
+		case "/reject":
+			w.WriteHeader(http.StatusExpectationFailed)
+		case "/hints":
+			w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+			w.WriteHeader(http.StatusEarlyHints)
+			w.Header().Del("Link")
+			w.Write([]byte("page"))
+		}
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+	targetURL, _ := url.Parse(target.URL)
+
+	cfg := config.DefaultConfig()
+	cfg.Proxy.URL = upstream.URL
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: targetURL.Host}
+
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(io.Discard)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	defer client.CloseIdleConnections()
+
+	t.Run("Trailers are forwarded both ways", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/trailers", io.NopCloser(strings.NewReader("payload")))
+		req.ContentLength = -1
+		req.Trailer = http.Header{"X-Request-Sum": []string{"xyz"}}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "payload xyz" {
+			t.Errorf("Expected request trailer to reach the target, got body %q", body)
+		}
+		if got := resp.Trailer.Get("X-Checksum"); got != "abc123" {
+			t.Errorf("Expected trailer X-Checksum abc123, got %q", got)
+		}
+	})
+
+	t.Run("Expect 100-continue is answered by the target", func(t *testing.T) {
+		send := func(path string) (*http.Response, bool) {
+			var continued bool
+			req, _ := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader("upload body"))
+			req.Header.Set("Expect", "100-continue")
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+				Got100Continue: func() { continued = true },
+			}))
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			return resp, continued
+		}
+
+		resp, continued := send("/upload")
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !continued {
+			t.Error("Expected 100 Continue when the target reads the body")
+		}
+		if string(body) != "upload body" {
+			t.Errorf("Expected body to be uploaded, got %q", body)
+		}
+
+		resp, continued = send("/reject")
+		resp.Body.Close()
+		if continued {
+			t.Error("Expected no 100 Continue when the target rejects the request")
+		}
+		if resp.StatusCode != http.StatusExpectationFailed {
+			t.Errorf("Expected status 417, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Early hints are relayed", func(t *testing.T) {
+		var hints []string
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/hints", nil)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					hints = append(hints, header.Get("Link"))
+				}
+				return nil
+			},
+		}))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if len(hints) != 1 || hints[0] != "</style.css>; rel=preload; as=style" {
+			t.Errorf("Expected one 103 with the preload link, got %q", hints)
+		}
+		if resp.Header.Get("Link") != "" {
+			t.Errorf("Expected Link only on the early hints, got %q", resp.Header.Get("Link"))
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != "page" {
+			t.Errorf("Expected 200 page, got %d %q", resp.StatusCode, body)
+		}
+	})
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"xff":       r.Header.Get("X-Forwarded-For"),
+			"proto":     r.Header.Get("X-Forwarded-Proto"),
+			"host":      r.Header.Get("X-Forwarded-Host"),
+			"forwarded": r.Header.Get("Forwarded"),
+		})
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+	targetURL, _ := url.Parse(target.URL)
+
+	send := func(t *testing.T, headers config.ForwardedHeadersConfig, useTLS bool) map[string]string {
+		t.Helper()
+
+		cfg := config.DefaultConfig()
+		cfg.Proxy.URL = upstream.URL
+		cfg.Target = config.TargetConfig{Scheme: "http", Host: targetURL.Host}
+		cfg.ForwardedHeaders = headers
+
+		logger := logging.NewLogger(&cfg.Logging)
+		logger.SetOutput(io.Discard)
+		handler, err := proxy.NewHandler(cfg, logger)
+		if err != nil {
+			t.Fatalf("Failed to create handler: %v", err)
+		}
+
+		var server *httptest.Server
+		if useTLS {
+			server = httptest.NewTLSServer(handler)
+		} else {
+			server = httptest.NewServer(handler)
+		}
+		defer server.Close()
+
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("Forwarded", "for=203.0.113.7;proto=https")
+
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var seen map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&seen); err != nil {
+			t.Fatalf("Failed to decode target response: %v", err)
+		}
+		seen["server"] = strings.TrimPrefix(strings.TrimPrefix(server.URL, "http://"), "https://")
+		return seen
+	}
+
+	t.Run("Untrusted client chains are replaced", func(t *testing.T) {
+		seen := send(t, config.ForwardedHeadersConfig{}, false)
+
+		if seen["xff"] != "127.0.0.1" {
+			t.Errorf("Expected X-Forwarded-For 127.0.0.1 without port, got %q", seen["xff"])
+		}
+		if seen["proto"] != "http" {
+			t.Errorf("Expected X-Forwarded-Proto http, got %q", seen["proto"])
+		}
+		if seen["host"] != seen["server"] {
+			t.Errorf("Expected X-Forwarded-Host %q, got %q", seen["server"], seen["host"])
+		}
+		if seen["forwarded"] != "" {
+			t.Errorf("Expected client Forwarded header to be dropped, got %q", seen["forwarded"])
+		}
+	})
+
+	t.Run("Trusted proxy chains are extended", func(t *testing.T) {
+		seen := send(t, config.ForwardedHeadersConfig{
+			Mode:           config.ForwardedHeadersBoth,
+			TrustedProxies: []string{"127.0.0.0/8"},
+		}, false)
+
+		if seen["xff"] != "203.0.113.7, 127.0.0.1" {
+			t.Errorf("Expected appended X-Forwarded-For, got %q", seen["xff"])
+		}
+		if seen["proto"] != "https" {
+			t.Errorf("Expected trusted X-Forwarded-Proto to be kept, got %q", seen["proto"])
+		}
+		want := `for=203.0.113.7;proto=https, for=127.0.0.1;proto=http;host="` + seen["server"] + `"`
+		if seen["forwarded"] != want {
+			t.Errorf("Expected Forwarded %q, got %q", want, seen["forwarded"])
+		}
+	})
+
+	t.Run("Protocol comes from TLS", func(t *testing.T) {
+		seen := send(t, config.ForwardedHeadersConfig{Mode: config.ForwardedHeadersRFC7239}, true)
+
+		want := `for=127.0.0.1;proto=https;host="` + seen["server"] + `"`
+		if seen["forwarded"] != want {
+			t.Errorf("Expected Forwarded %q, got %q", want, seen["forwarded"])
+		}
+		if seen["xff"] != "" || seen["proto"] != "" {
+			t.Errorf("Expected no X-Forwarded headers, got %q and %q", seen["xff"], seen["proto"])
+		}
+	})
+
+	t.Run("Mode none strips everything", func(t *testing.T) {
+		seen := send(t, config.ForwardedHeadersConfig{Mode: config.ForwardedHeadersNone}, false)
+
+		for _, name := range []string{"xff", "proto", "host", "forwarded"} {
+			if seen[name] != "" {
+				t.Errorf("Expected %s to be stripped, got %q", name, seen[name])
+			}
+		}
+	})
+}
+
+func TestHeaderRules(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "http://internal.example/next?page=2")
+		w.Header().Set("X-Internal", "node-7")
+		json.NewEncoder(w).Encode(map[string]string{
+			"user_agent": r.Header.Get("User-Agent"),
+			"cookie":     r.Header.Get("Cookie"),
+			"api_key":    r.Header.Get("X-Api-Key"),
+			"client":     r.Header.Get("X-Client"),
+		})
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+	targetURL, _ := url.Parse(target.URL)
+
+	cfg := config.DefaultConfig()
+	cfg.Proxy.URL = upstream.URL
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: targetURL.Host}
+	cfg.Headers = config.HeaderRulesConfig{
+		Request: []config.HeaderRule{
+			{Action: config.HeaderActionSet, Name: "User-Agent", Value: "proxy-bot/1.0"},
+			{Action: config.HeaderActionRemove, Name: "Cookie"},
+		},
+		Response: []config.HeaderRule{
+			{Action: config.HeaderActionRemove, Name: "X-Internal"},
+		},
+	}
+	cfg.Routes = []config.RouteConfig{{
+		Name:       "api",
+		PathPrefix: "/api",
+		Target:     cfg.Target,
+		Headers: config.HeaderRulesConfig{
+			Request: []config.HeaderRule{
+				{Action: config.HeaderActionAdd, Name: "X-Api-Key", Value: "secret"},
+				{Action: config.HeaderActionSet, Name: "X-Client", Value: "${client_ip} ${request_id} ${target_host}"},
+			},
+			Response: []config.HeaderRule{
+				{Action: config.HeaderActionReplace, Name: "Location", Pattern: `^http://internal\.example/(.*)$`, Value: "https://${route}.public.example/$1"},
+			},
+		},
+	}}
+
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(io.Discard)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	get := func(t *testing.T, path string) (*http.Response, map[string]string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		req.Header.Set("User-Agent", "curl/8.0")
+		req.Header.Set("Cookie", "session=abc")
+		req.Header.Set("X-Request-Id", "rules-test")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var seen map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&seen); err != nil {
+			t.Fatalf("Failed to decode target response: %v", err)
+		}
+		return resp, seen
+	}
+
+	t.Run("Top-level rules apply to every route", func(t *testing.T) {
+		resp, seen := get(t, "/other")
+
+		if seen["user_agent"] != "proxy-bot/1.0" {
+			t.Errorf("Expected User-Agent to be set, got %q", seen["user_agent"])
+		}
+		if seen["cookie"] != "" {
+			t.Errorf("Expected Cookie to be removed, got %q", seen["cookie"])
+		}
+		if seen["api_key"] != "" {
+			t.Errorf("Expected no API key outside the api route, got %q", seen["api_key"])
+		}
+		if resp.Header.Get("X-Internal") != "" {
+			t.Errorf("Expected X-Internal to be removed, got %q", resp.Header.Get("X-Internal"))
+		}
+		if resp.Header.Get("Location") != "http://internal.example/next?page=2" {
+			t.Errorf("Expected Location untouched, got %q", resp.Header.Get("Location"))
+		}
+	})
+
+	t.Run("Route rules add to the top-level ones", func(t *testing.T) {
+		resp, seen := get(t, "/api/items")
+
+		if seen["user_agent"] != "proxy-bot/1.0" || seen["cookie"] != "" {
+			t.Errorf("Expected top-level rules to apply, got %v", seen)
+		}
+		if seen["api_key"] != "secret" {
+			t.Errorf("Expected API key to be added, got %q", seen["api_key"])
+		}
+		if want := "127.0.0.1 rules-test " + targetURL.Host; seen["client"] != want {
+			t.Errorf("Expected templated header %q, got %q", want, seen["client"])
+		}
+		if got := resp.Header.Get("Location"); got != "https://api.public.example/next?page=2" {
+			t.Errorf("Expected rewritten Location, got %q", got)
+		}
+	})
+
+	t.Run("Unknown variables are rejected", func(t *testing.T) {
+		bad := config.DefaultConfig()
+		bad.Headers.Request = []config.HeaderRule{{Action: config.HeaderActionSet, Name: "X-Who", Value: "${user}"}}
+
+		path := filepath.Join(t.TempDir(), "config.json")
+		data, _ := json.Marshal(bad)
+		os.WriteFile(path, data, 0644)
+
+		if _, err := config.LoadConfig(path); err == nil || !strings.Contains(err.Error(), "${user}") {
+			t.Errorf("Expected unknown variable error, got %v", err)
+		}
+	})
+}
+
+func TestResponseRewriting(t *testing.T) {
+	var targetHost string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := "http://" + targetHost
+		switch r.URL.Path {
+		case "/redirect":
+			w.Header().Set("Location", origin+"/next?page=2")
+			w.Header().Set("Refresh", "0; url="+origin+"/refreshed")
+			w.Header().Add("Set-Cookie", "session=abc; Domain=127.0.0.1; Path=/; HttpOnly")
+			w.Header().Add("Set-Cookie", "other=1; Domain=example.org")
+			w.WriteHeader(http.StatusFound)
+		case "/relative":
+			w.Header().Set("Location", "/login")
+			w.WriteHeader(http.StatusFound)
+		default:
+			// Split the page mid-URL to check matches across writes.
+			page := `<a href="` + origin + `/a">a</a> <script>var u = "http:\/\/` + targetHost + `\/b";</script> <a href="http://` + targetHost + `0/c">c</a>`
+			half := len(page) / 3
+
+			var body io.Writer = w
+			var closer io.Closer
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			switch r.URL.Path {
+			case "/gzip":
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				body, closer = gz, gz
+			case "/br":
+				w.Header().Set("Content-Encoding", "br")
+				br := brotli.NewWriter(w)
+				body, closer = br, br
+			}
+			io.WriteString(body, page[:half])
+			if f, ok := body.(interface{ Flush() error }); ok {
+				f.Flush()
+			}
+			w.(http.Flusher).Flush()
+			io.WriteString(body, page[half:])
+			if closer != nil {
+				closer.Close()
+			}
+		}
+	}))
+	defer target.Close()
+	targetHost = strings.TrimPrefix(target.URL, "http://")
+
+	upstream := newTestUpstreamProxy(t)
+
+	cfg := config.DefaultConfig()
+	cfg.Proxy.URL = upstream.URL
+	cfg.Target = config.TargetConfig{Scheme: "http", Host: targetHost}
+	cfg.Rewrite = config.RewriteConfig{
+		Enabled:   true,
+		PublicURL: "https://public.example",
+		Body:      true,
+	}
+	cfg.Routes = []config.RouteConfig{{
+		Name:        "app",
+		PathPrefix:  "/app",
+		StripPrefix: true,
+		Target:      cfg.Target,
+	}}
+
+	logger := logging.NewLogger(&cfg.Logging)
+	logger.SetOutput(io.Discard)
+	handler, err := proxy.NewHandler(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableCompression: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	t.Run("Redirects and cookies point at the proxy", func(t *testing.T) {
+		resp, err := client.Get(server.URL + "/redirect")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if got := resp.Header.Get("Location"); got != "https://public.example/next?page=2" {
+			t.Errorf("Expected rewritten Location, got %q", got)
+		}
+		if got := resp.Header.Get("Refresh"); got != "0; url=https://public.example/refreshed" {
+			t.Errorf("Expected rewritten Refresh, got %q", got)
+		}
+		cookies := resp.Header.Values("Set-Cookie")
+		if len(cookies) != 2 || cookies[0] != "session=abc; Domain=public.example; Path=/; HttpOnly" || cookies[1] != "other=1; Domain=example.org" {
+			t.Errorf("Expected only the target's cookie domain to be rewritten, got %q", cookies)
+		}
+	})
+
+	t.Run("Redirects get the route prefix back", func(t *testing.T) {
+		for path, want := range map[string]string{
+			"/app/relative": "/app/login",
+			"/app/redirect": "https://public.example/app/next?page=2",
+		} {
+			resp, err := client.Get(server.URL + path)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if got := resp.Header.Get("Location"); got != want {
+				t.Errorf("Expected Location %q for %s, got %q", want, path, got)
+			}
+		}
+	})
+
+	want := `<a href="https://public.example/a">a</a> <script>var u = "https:\/\/public.example\/b";</script> <a href="http://` + targetHost + `0/c">c</a>`
+	for _, encoding := range []string{"identity", "gzip", "br"} {
+		t.Run("Body URLs are rewritten with "+encoding+" encoding", func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/"+encoding, nil)
+			req.Header.Set("Accept-Encoding", "gzip, br, zstd")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			var body io.Reader = resp.Body
+			switch encoding {
+			case "gzip":
+				gz, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatalf("Expected a gzip body: %v", err)
+				}
+				body = gz
+			case "br":
+				body = brotli.NewReader(resp.Body)
+			}
+			if got := resp.Header.Get("Content-Encoding"); encoding != "identity" && got != encoding {
+				t.Errorf("Expected Content-Encoding %s, got %q", encoding, got)
+			}
+
+			data, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("Failed to read body: %v", err)
+			}
+			if string(data) != want {
+				t.Errorf("Expected rewritten body\n%s\ngot\n%s", want, data)
+			}
+		})
+	}
+}
+
+// testCert is a certificate and key written to PEM files for TLS tests.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert issues a certificate from template, signed by parent or
+// self-signed when parent is nil.
+func newTestCert(t *testing.T, parent *testCert, template *x509.Certificate) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if template.IsCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.BasicConstraintsValid = true
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	dir := t.TempDir()
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, "cert.pem"),
+		keyFile:  filepath.Join(dir, "key.pem"),
+	}
+	os.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return tc
+}
+
+func TestServerTLS(t *testing.T) {
+	certA := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "a.test"}, DNSNames: []string{"a.test"}})
+	certB := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "b.test"}, DNSNames: []string{"b.test", "*.b.test"}})
+
+	tlsConfig, store, err := tlsutil.NewServerConfig(&config.TLSServerConfig{
+		Enabled:      true,
+		CertFile:     certA.certFile,
+		KeyFile:      certA.keyFile,
+		Certificates: []config.CertificateConfig{{CertFile: certB.certFile, KeyFile: certB.keyFile}},
+		MinVersion:   "1.2",
+	})
+	if err != nil {
+		t.Fatalf("Failed to build TLS config: %v", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	served := func(t *testing.T, serverName string, maxVersion uint16) (string, error) {
+		t.Helper()
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			MaxVersion:         maxVersion,
+		})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	t.Run("Certificate is chosen by SNI", func(t *testing.T) {
+		for serverName, want := range map[string]string{
+			"a.test":     "a.test",
+			"b.test":     "b.test",
+			"www.b.test": "b.test",
+			"other.test": "a.test",
+			"":           "a.test",
+		} {
+			got, err := served(t, serverName, 0)
+			if err != nil {
+				t.Fatalf("Handshake for %q failed: %v", serverName, err)
+			}
+			if got != want {
+				t.Errorf("Expected certificate %s for %q, got %s", want, serverName, got)
+			}
+		}
+	})
+
+	t.Run("Old TLS versions are refused", func(t *testing.T) {
+		if _, err := served(t, "a.test", tls.VersionTLS11); err == nil {
+			t.Error("Expected a TLS 1.1 handshake to fail")
+		}
+
+		for _, version := range []string{"1.0", "1.1"} {
+			if _, err := config.ParseTLSVersion(version); err == nil {
+				t.Errorf("Expected min_version %s to be rejected", version)
+			}
+		}
+	})
+
+	t.Run("Certificates reload from disk", func(t *testing.T) {
+		renewed := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "a.test renewed"}, DNSNames: []string{"a.test"}})
+		for src, dst := range map[string]string{renewed.certFile: certA.certFile, renewed.keyFile: certA.keyFile} {
+			data, _ := os.ReadFile(src)
+			os.WriteFile(dst, data, 0600)
+		}
+
+		if err := store.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+		if got, _ := served(t, "a.test", 0); got != "a.test renewed" {
+			t.Errorf("Expected the renewed certificate, got %s", got)
+		}
+
+		os.WriteFile(certA.keyFile, []byte("not a key"), 0600)
+		if err := store.Reload(); err == nil {
+			t.Error("Expected reload of a broken key to fail")
+		}
+		if got, _ := served(t, "a.test", 0); got != "a.test renewed" {
+			t.Errorf("Expected the last good certificate to stay in use, got %s", got)
+		}
+	})
+
+	t.Run("Plain HTTP port redirects to HTTPS", func(t *testing.T) {
+		handler := redirectToHTTPS(8443)
+		for method, status := range map[string]int{http.MethodGet: http.StatusMovedPermanently, http.MethodPost: http.StatusPermanentRedirect} {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(method, "http://example.com:8080/path?q=1", nil))
+
+			if rec.Code != status {
+				t.Errorf("Expected status %d for %s, got %d", status, method, rec.Code)
+			}
+			if got := rec.Header().Get("Location"); got != "https://example.com:8443/path?q=1" {
+				t.Errorf("Expected redirect to the HTTPS port, got %q", got)
+			}
+		}
+	})
+}
+
+func TestClientCertAuth(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Client-Cert")))
+	}))
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+	targetURL, _ := url.Parse(target.URL)
+
+	ca := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "Test CA"}, IsCA: true})
+	serverCert := newTestCert(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "proxy.test"}, DNSNames: []string{"proxy.test"}})
+	billing := newTestCert(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "billing", Organization: []string{"Example"}}})
+	reports := newTestCert(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "reports"}})
+	rogue := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}})
+
+	start := func(t *testing.T, clientCerts config.ClientCertConfig, authCfg config.AuthConfig, limit config.RateLimitConfig) *httptest.Server {
+		t.Helper()
+
+		cfg := config.DefaultConfig()
+		cfg.Proxy.URL = upstream.URL
+		cfg.Target = config.TargetConfig{Scheme: "http", Host: targetURL.Host}
+		cfg.Server.TLS = config.TLSServerConfig{
+			Enabled:     true,
+			CertFile:    serverCert.certFile,
+			KeyFile:     serverCert.keyFile,
+			ClientCerts: clientCerts,
+		}
+		cfg.Auth = authCfg
+		cfg.RateLimit = limit
+
+		logger := logging.NewLogger(&cfg.Logging)
+		logger.SetOutput(io.Discard)
+		handler, err := proxy.NewHandler(cfg, logger)
+		if err != nil {
+			t.Fatalf("Failed to create handler: %v", err)
+		}
+		tlsConfig, _, err := tlsutil.NewServerConfig(&cfg.Server.TLS)
+		if err != nil {
+			t.Fatalf("Failed to build TLS config: %v", err)
+		}
+
+		server := httptest.NewUnstartedServer(handler)
+		server.TLS = tlsConfig
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	get := func(server *httptest.Server, cert *testCert, header http.Header) (*http.Response, string, error) {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			pair, err := tls.LoadX509KeyPair(cert.certFile, cert.keyFile)
+			if err != nil {
+				return nil, "", err
+			}
+			// Offered even when the server's CA list does not cover it.
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &pair, nil
+			}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		defer client.CloseIdleConnections()
+
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body), nil
+	}
+
+	optional := config.ClientCertConfig{
+		Mode:   config.ClientCertOptional,
+		CAFile: ca.certFile,
+		Header: "X-Client-Cert",
+		Fields: []string{"common_name", "subject", "serial"},
+	}
+
+	t.Run("Certificate details reach the target", func(t *testing.T) {
+		server := start(t, optional, config.AuthConfig{}, config.RateLimitConfig{})
+
+		resp, body, err := get(server, billing, http.Header{"X-Client-Cert": {"common_name=admin"}})
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		want := fmt.Sprintf(`common_name=billing;subject="CN=billing,O=Example";serial=%s`, billing.cert.SerialNumber)
+		if body != want {
+			t.Errorf("Expected header %q, got %q", want, body)
+		}
+
+		// Without a certificate, a header sent by the client is dropped.
+		resp, body, err = get(server, nil, http.Header{"X-Client-Cert": {"common_name=admin"}})
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK || body != "" {
+			t.Errorf("Expected 200 and no header without a certificate, got %d and %q", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("Certificates from other CAs are refused", func(t *testing.T) {
+		server := start(t, optional, config.AuthConfig{}, config.RateLimitConfig{})
+
+		if _, _, err := get(server, rogue, nil); err == nil {
+			t.Error("Expected a certificate from an unknown CA to fail the handshake")
+		}
+	})
+
+	t.Run("Required certificates", func(t *testing.T) {
+		required := optional
+		required.Mode = config.ClientCertRequire
+		server := start(t, required, config.AuthConfig{}, config.RateLimitConfig{})
+
+		if _, _, err := get(server, nil, nil); err == nil {
+			t.Error("Expected a client without a certificate to be refused")
+		}
+		if resp, _, err := get(server, billing, nil); err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected a client with a certificate to be served, got %v", err)
+		}
+	})
+
+	t.Run("Certificate counts as authentication", func(t *testing.T) {
+		authCfg := config.AuthConfig{
+			Enabled: true,
+			APIKeys: []config.APIKeyConfig{{Client: "scraper", Key: "secret"}},
+		}
+		server := start(t, optional, authCfg, config.RateLimitConfig{})
+
+		if resp, _, err := get(server, nil, nil); err != nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected 401 without credentials, got %v %v", resp, err)
+		}
+		if resp, _, err := get(server, billing, nil); err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected a certificate to authenticate, got %v %v", resp, err)
+		}
+		if resp, _, err := get(server, nil, http.Header{"X-Api-Key": {"secret"}}); err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected an API key to still authenticate, got %v %v", resp, err)
+		}
+	})
+
+	t.Run("Rate limits apply per certificate identity", func(t *testing.T) {
+		limit := config.RateLimitConfig{
+			Enabled:           true,
+			Key:               config.RateLimitKeyAPIKey,
+			RequestsPerSecond: 0.001,
+			Burst:             1,
+		}
+		server := start(t, optional, config.AuthConfig{}, limit)
+
+		for _, step := range []struct {
+			cert   *testCert
+			status int
+		}{
+			{billing, http.StatusOK},
+			{billing, http.StatusTooManyRequests},
+			{reports, http.StatusOK},
+		} {
+			resp, _, err := get(server, step.cert, nil)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			if resp.StatusCode != step.status {
+				t.Errorf("Expected status %d for %s, got %d", step.status, step.cert.cert.Subject.CommonName, resp.StatusCode)
+			}
+		}
+	})
+}
+
+func TestTargetTLS(t *testing.T) {
+	ca := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "Target CA"}, IsCA: true})
+	targetCert := newTestCert(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "target.test"}, DNSNames: []string{"target.test"}})
+	clientCA := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "Client CA"}, IsCA: true})
+	clientCert := newTestCert(t, clientCA, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy-client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	pair, _ := tls.LoadX509KeyPair(targetCert.certFile, targetCert.keyFile)
+	clientCAs, _ := tlsutil.LoadCertPool(clientCA.certFile)
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	target.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	target.StartTLS()
+	defer target.Close()
+
+	upstream := newTestUpstreamProxy(t)
+	targetURL, _ := url.Parse(target.URL)
+	goodPin := "sha256/" + base64.StdEncoding.EncodeToString(sha256Sum(targetCert.cert.RawSubjectPublicKeyInfo))
+	caPin := "sha256/" + base64.StdEncoding.EncodeToString(sha256Sum(ca.cert.RawSubjectPublicKeyInfo))
+	wrongPin := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	sendTo := func(t *testing.T, host string, settings config.TargetTLSConfig) (int, string, string) {
+		t.Helper()
+
+		cfg := config.DefaultConfig()
+		cfg.Proxy.URL = upstream.URL
+		cfg.Target = config.TargetConfig{Scheme: "https", Host: host, TLS: settings}
+
+		logger := logging.NewLogger(&cfg.Logging)
+		logger.SetOutput(io.Discard)
+		handler, err := proxy.NewHandler(cfg, logger)
+		if err != nil {
+			t.Fatalf("Failed to create handler: %v", err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", handler.Metrics)
+		mux.HandleFunc("/", handler.ServeHTTP)
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + "/")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		status := resp.StatusCode
+
+		resp, err = http.Get(server.URL + "/metrics?format=prometheus")
+		if err != nil {
+			t.Fatalf("Metrics request failed: %v", err)
+		}
+		metricsBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return status, string(body), string(metricsBody)
+	}
+	send := func(t *testing.T, settings config.TargetTLSConfig) (int, string, string) {
+		t.Helper()
+		return sendTo(t, targetURL.Host, settings)
+	}
+
+	t.Run("Unknown CA is refused by default", func(t *testing.T) {
+		if status, _, _ := send(t, config.TargetTLSConfig{}); status != http.StatusBadGateway {
+			t.Errorf("Expected status 502, got %d", status)
+		}
+	})
+
+	t.Run("Custom CA, server name and client certificate", func(t *testing.T) {
+		status, body, _ := send(t, config.TargetTLSConfig{
+			CAFile:     ca.certFile,
+			ServerName: "target.test",
+			CertFile:   clientCert.certFile,
+			KeyFile:    clientCert.keyFile,
+		})
+		if status != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", status)
+		}
+		if body != "proxy-client" {
+			t.Errorf("Expected the target to see our client certificate, got %q", body)
+		}
+	})
+
+	t.Run("Server name must match the certificate", func(t *testing.T) {
+		status, _, _ := send(t, config.TargetTLSConfig{CAFile: ca.certFile, ServerName: "other.test"})
+		if status != http.StatusBadGateway {
+			t.Errorf("Expected status 502, got %d", status)
+		}
+	})
+
+	t.Run("Pinned keys", func(t *testing.T) {
+		for _, pin := range []string{goodPin, caPin} {
+			status, _, _ := send(t, config.TargetTLSConfig{CAFile: ca.certFile, ServerName: "target.test", PinnedKeys: []string{wrongPin, pin}})
+			if status != http.StatusOK {
+				t.Errorf("Expected status 200 with pin %s, got %d", pin, status)
+			}
+		}
+
+		status, _, metrics := send(t, config.TargetTLSConfig{CAFile: ca.certFile, ServerName: "target.test", PinnedKeys: []string{wrongPin}})
+		if status != http.StatusBadGateway {
+			t.Errorf("Expected status 502 for a pin mismatch, got %d", status)
+		}
+		want := fmt.Sprintf(`proxy_tls_pin_failures_total{target=%q}`, targetURL.Host)
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expected the pin failure to be counted, got:\n%s", metrics)
+		}
+	})
+
+	t.Run("Insecure skip verify", func(t *testing.T) {
+		if status, _, _ := send(t, config.TargetTLSConfig{InsecureSkipVerify: true}); status != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", status)
+		}
+		// Pins still apply when verification is off.
+		if status, _, _ := send(t, config.TargetTLSConfig{InsecureSkipVerify: true, PinnedKeys: []string{wrongPin}}); status != http.StatusBadGateway {
+			t.Errorf("Expected status 502 for a pin mismatch, got %d", status)
+		}
+	})
+
+	t.Run("Pinned certificates sent by an impostor do not count", func(t *testing.T) {
+		// An impostor with its own CA adds the real, public, target and CA
+		// certificates to the chain it presents.
+		impostorCA := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "Impostor CA"}, IsCA: true})
+		impostorCert := newTestCert(t, impostorCA, &x509.Certificate{Subject: pkix.Name{CommonName: "target.test"}, DNSNames: []string{"target.test"}})
+		impostorPair, _ := tls.LoadX509KeyPair(impostorCert.certFile, impostorCert.keyFile)
+		impostorPair.Certificate = append(impostorPair.Certificate, targetCert.cert.Raw, ca.cert.Raw)
+
+		impostor := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("impostor"))
+		}))
+		impostor.TLS = &tls.Config{Certificates: []tls.Certificate{impostorPair}}
+		impostor.StartTLS()
+		defer impostor.Close()
+		impostorURL, _ := url.Parse(impostor.URL)
+
+		for _, pin := range []string{goodPin, caPin} {
+			verified := config.TargetTLSConfig{CAFile: impostorCA.certFile, ServerName: "target.test", PinnedKeys: []string{pin}}
+			if status, body, _ := sendTo(t, impostorURL.Host, verified); status != http.StatusBadGateway {
+				t.Errorf("Expected status 502 with pin %s outside the verified chain, got %d %q", pin, status, body)
+			}
+
+			insecure := config.TargetTLSConfig{InsecureSkipVerify: true, PinnedKeys: []string{pin}}
+			if status, body, _ := sendTo(t, impostorURL.Host, insecure); status != http.StatusBadGateway {
+				t.Errorf("Expected status 502 with pin %s on an unverified chain, got %d %q", pin, status, body)
+			}
+		}
+	})
+
+	t.Run("Invalid settings are rejected", func(t *testing.T) {
+		load := func(mutate func(*config.Config)) error {
+			cfg := config.DefaultConfig()
+			cfg.Target.Scheme = "https"
+			cfg.Target.TLS = config.TargetTLSConfig{ServerName: "target.test", PinnedKeys: []string{goodPin}}
+			mutate(cfg)
+
+			path := filepath.Join(t.TempDir(), "config.json")
+			data, _ := json.Marshal(cfg)
+			os.WriteFile(path, data, 0644)
+			_, err := config.LoadConfig(path)
+			return err
+		}
+
+		if err := load(func(*config.Config) {}); err != nil {
+			t.Fatalf("Expected valid settings to load, got %v", err)
+		}
+
+		for name, mutate := range map[string]func(*config.Config){
+			"plain http target": func(c *config.Config) {
+				c.Target.Scheme = "http"
+			},
+			"malformed pin": func(c *config.Config) {
+				c.Target.TLS.PinnedKeys = []string{"md5/abc"}
+			},
+			"cert without key": func(c *config.Config) {
+				c.Target.TLS.CertFile = clientCert.certFile
+			},
+			"conflicting settings for a host": func(c *config.Config) {
+				c.Routes = []config.RouteConfig{{
+					Name:       "api",
+					PathPrefix: "/api",
+					Target:     config.TargetConfig{Scheme: "https", Host: c.Target.Host, TLS: config.TargetTLSConfig{InsecureSkipVerify: true}},
+				}}
+			},
+		} {
+			if err := load(mutate); err == nil {
+				t.Errorf("Expected %s to be rejected", name)
+			}
+		}
+	})
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// testSOCKSProxy is a minimal SOCKS5 server standing in for a provider that
+// only offers SOCKS. Host names it is asked to resolve are looked up in
+// hosts, so tests can tell remote resolution from local.
+type testSOCKSProxy struct {
+	addr string
+
+	mu        sync.Mutex
+	requested []string
+}
+
+func (p *testSOCKSProxy) lastRequested() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.requested) == 0 {
+		return ""
+	}
+	return p.requested[len(p.requested)-1]
+}
+
+func newTestSOCKSProxy(t *testing.T, username, password string, hosts map[string]string) *testSOCKSProxy {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	p := &testSOCKSProxy{addr: listener.Addr().String()}
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 512)
+
+		// Greeting: version, method count, methods.
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != 5 {
+			return
+		}
+		methods := buf[2 : 2+int(buf[1])]
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		if !bytes.Contains(methods, []byte{0x02}) {
+			conn.Write([]byte{5, 0xff})
+			return
+		}
+		conn.Write([]byte{5, 0x02})
+
+		// RFC 1929 username and password.
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != username || string(pass) != password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+
+		// CONNECT request.
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil || buf[1] != 1 {
+			return
+		}
+		var host, requested string
+		switch buf[3] {
+		case 1:
+			io.ReadFull(conn, buf[:4])
+			host = net.IP(buf[:4]).String()
+			requested = "ipv4:" + host
+		case 4:
+			io.ReadFull(conn, buf[:16])
+			host = net.IP(buf[:16]).String()
+			requested = "ipv6:" + host
+		case 3:
+			io.ReadFull(conn, buf[:1])
+			name := make([]byte, buf[0])
+			io.ReadFull(conn, name)
+			host = hosts[string(name)]
+			requested = "domain:" + string(name)
+		}
+		io.ReadFull(conn, buf[:2])
+		port := int(buf[0])<<8 | int(buf[1])
+
+		p.mu.Lock()
+		p.requested = append(p.requested, requested)
+		p.mu.Unlock()
+
+		targetConn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if host == "" || err != nil {
+			// Host unreachable.
+			conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer targetConn.Close()
+		conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+
+		go io.Copy(targetConn, conn)
+		io.Copy(conn, targetConn)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return p
+}
+
+func TestSOCKSUpstream(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("via socks " + r.URL.Path))
+	}))
+	defer target.Close()
+	_, targetPort, _ := net.SplitHostPort(strings.TrimPrefix(target.URL, "http://"))
+
+	socks := newTestSOCKSProxy(t, "socks-user", "socks-pass", map[string]string{"socks-target.test": "127.0.0.1"})
+
+	start := func(t *testing.T, proxyURL, password, targetHost string) *httptest.Server {
+		t.Helper()
+
+		cfg := config.DefaultConfig()
+		cfg.Proxy.URL = proxyURL
+		cfg.Proxy.Username = "socks-user"
+		cfg.Proxy.Password = password
+		cfg.Target = config.TargetConfig{Scheme: "http", Host: targetHost}
+		cfg.Retry.MaxAttempts = 1
+		cfg.Forward = config.ForwardConfig{Enabled: true, AllowedHosts: []string{"socks-target.test:*", "localhost:*"}}
+
+		logger := logging.NewLogger(&cfg.Logging)
+		logger.SetOutput(io.Discard)
+		handler, err := proxy.NewHandler(cfg, logger)
+		if err != nil {
+			t.Fatalf("Failed to create handler: %v", err)
+		}
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	get := func(t *testing.T, url string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("socks5h resolves names on the proxy", func(t *testing.T) {
+		server := start(t, "socks5h://"+socks.addr, "socks-pass", "socks-target.test:"+targetPort)
+
+		status, body := get(t, server.URL+"/remote")
+		if status != http.StatusOK || body != "via socks /remote" {
+			t.Fatalf("Expected the target's response, got %d %q", status, body)
+		}
+		if got := socks.lastRequested(); got != "domain:socks-target.test" {
+			t.Errorf("Expected the proxy to be asked for the host name, got %q", got)
+		}
+	})
+
+	t.Run("socks5 resolves names locally", func(t *testing.T) {
+		server := start(t, "socks5://"+socks.addr, "socks-pass", "localhost:"+targetPort)
+
+		status, body := get(t, server.URL+"/local")
+		if status != http.StatusOK || body != "via socks /local" {
+			t.Fatalf("Expected the target's response, got %d %q", status, body)
+		}
+		if got := socks.lastRequested(); got != "ipv4:127.0.0.1" && got != "ipv6:::1" {
+			t.Errorf("Expected the proxy to be asked for an address, got %q", got)
+		}
+	})
+
+	t.Run("CONNECT tunnels go through SOCKS", func(t *testing.T) {
+		tlsTarget := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("tunnelled"))
+		}))
+		defer tlsTarget.Close()
+		_, tlsPort, _ := net.SplitHostPort(strings.TrimPrefix(tlsTarget.URL, "https://"))
+
+		server := start(t, "socks5h://"+socks.addr, "socks-pass", "socks-target.test:"+targetPort)
+		proxyURL, _ := url.Parse(server.URL)
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+
+		resp, err := client.Get("https://socks-target.test:" + tlsPort + "/")
+		if err != nil {
+			t.Fatalf("Request through the tunnel failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "tunnelled" {
+			t.Errorf("Expected the tunnelled response, got %q", body)
+		}
+		if got := socks.lastRequested(); got != "domain:socks-target.test" {
+			t.Errorf("Expected the tunnel to be opened by name, got %q", got)
+		}
+	})
+
+	t.Run("Wrong credentials fail the request", func(t *testing.T) {
+		server := start(t, "socks5h://"+socks.addr, "wrong", "socks-target.test:"+targetPort)
+
+		if status, _ := get(t, server.URL+"/"); status != http.StatusBadGateway {
+			t.Errorf("Expected status 502, got %d", status)
+		}
+	})
+
+	t.Run("Unsupported schemes are rejected", func(t *testing.T) {
+		bad := config.DefaultConfig()
+		bad.Proxy.URL = "socks4://" + socks.addr
+
+		path := filepath.Join(t.TempDir(), "config.json")
+		data, _ := json.Marshal(bad)
+		os.WriteFile(path, data, 0644)
+
+		if _, err := config.LoadConfig(path); err == nil || !strings.Contains(err.Error(), "socks4") {
+			t.Errorf("Expected unsupported scheme error, got %v", err)
+		}
+	})
+}
+
+func TestHostACLSpellings(t *testing.T) {
+	acl, err := proxy.NewHostACL(&config.ForwardConfig{
+		Enabled:      true,
+		AllowedHosts: []string{"*"},
+		DeniedHosts:  []string{"evil.test", "*.evil.test", "1.2.3.4", "[::1]"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build ACL: %v", err)
+	}
+
+	for _, host := range []string{
+		"evil.test",
+		"evil.test.",
+		"EVIL.Test.",
+		"www.evil.test.",
+		"1.2.3.4",
+		"::ffff:1.2.3.4",
+		"::FFFF:1.2.3.4",
+		"0:0:0:0:0:0:0:1",
+		"",
+		".",
+	} {
+		if acl.Allowed(host, 443) {
+			t.Errorf("Expected %q to be denied", host)
+		}
+	}
+
+	for _, host := range []string{"good.test", "good.test.", "5.6.7.8", "::ffff:5.6.7.8"} {
+		if !acl.Allowed(host, 443) {
+			t.Errorf("Expected %q to be allowed", host)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"proxy/config"
+)
+
+const w3cHeader = "#Version: 1.0\n" +
+	"#Fields: date time c-ip cs-username cs-method cs-uri-stem cs-uri-query sc-status sc-bytes time-taken cs-host cs(User-Agent) cs(Referer)\n"
+
+// AccessEntry describes one request for the access log.
+type AccessEntry struct {
+	Time       time.Time
+	RemoteAddr string
+	User       string
+	Method     string
+	URI        string
+	Proto      string
+	Host       string
+	Status     int
+	Bytes      int64
+	Duration   time.Duration
+	Referer    string
+	UserAgent  string
+	Route      string
+	RequestID  string
+}
+
+// AccessLogger writes one line per request in Apache Combined, W3C extended
+// or JSON-lines format.
+type AccessLogger struct {
+	writer io.WriteCloser
+	format string
+}
+
+func NewAccessLogger(cfg *config.AccessLogConfig) (*AccessLogger, error) {
+	format := cfg.Format
+	if format == "" {
+		format = config.AccessLogFormatCombined
+	}
+
+	opts := RotateOptions{
+		MaxBytes: cfg.MaxBytes,
+		Interval: time.Duration(cfg.RotateInterval),
+		Compress: cfg.Compress,
+	}
+	if format == config.AccessLogFormatW3C {
+		opts.Header = []byte(w3cHeader)
+	}
+
+	file, err := OpenRotatingFile(cfg.File, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLogger{writer: file, format: format}, nil
+}
+
+func (l *AccessLogger) Log(e *AccessEntry) error {
+	var line []byte
+	switch l.format {
+	case config.AccessLogFormatW3C:
+		line = []byte(formatW3C(e))
+	case config.AccessLogFormatJSON:
+		var err error
+		if line, err = formatAccessJSON(e); err != nil {
+			return err
+		}
+	default:
+		line = []byte(formatCombined(e))
+	}
+
+	_, err := l.writer.Write(append(line, '\n'))
+	return err
+}
+
+// Reopen reopens the log file after an external tool has rotated it.
+func (l *AccessLogger) Reopen() error {
+	if f, ok := l.writer.(*RotatingFile); ok {
+		return f.Reopen()
+	}
+	return nil
+}
+
+func (l *AccessLogger) Close() error {
+	return l.writer.Close()
+}
+
+func formatCombined(e *AccessEntry) string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s "%s" "%s"`,
+		orDash(e.RemoteAddr),
+		orDash(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		quoteEscape(e.Method), quoteEscape(e.URI), quoteEscape(e.Proto),
+		e.Status,
+		bytes,
+		quoteEscape(orDash(e.Referer)),
+		quoteEscape(orDash(e.UserAgent)),
+	)
+}
+
+func formatW3C(e *AccessEntry) string {
+	stem, query, _ := strings.Cut(e.URI, "?")
+	t := e.Time.UTC()
+	fields := []string{
+		t.Format("2006-01-02"),
+		t.Format("15:04:05"),
+		w3cField(e.RemoteAddr),
+		w3cField(e.User),
+		w3cField(e.Method),
+		w3cField(stem),
+		w3cField(query),
+		strconv.Itoa(e.Status),
+		strconv.FormatInt(e.Bytes, 10),
+		strconv.FormatFloat(e.Duration.Seconds(), 'f', 3, 64),
+		w3cField(e.Host),
+		w3cField(e.UserAgent),
+		w3cField(e.Referer),
+	}
+	return strings.Join(fields, " ")
+}
+
+func formatAccessJSON(e *AccessEntry) ([]byte, error) {
+	return json.Marshal(struct {
+		Time       string  `json:"time"`
+		RemoteAddr string  `json:"remote_ip"`
+		User       string  `json:"user,omitempty"`
+		Method     string  `json:"method"`
+		URI        string  `json:"uri"`
+		Proto      string  `json:"proto"`
+		Host       string  `json:"host,omitempty"`
+		Status     int     `json:"status"`
+		Bytes      int64   `json:"bytes"`
+		DurationMS float64 `json:"duration_ms"`
+		Referer    string  `json:"referer,omitempty"`
+		UserAgent  string  `json:"user_agent,omitempty"`
+		Route      string  `json:"route,omitempty"`
+		RequestID  string  `json:"request_id,omitempty"`
+	}{
+		Time:       e.Time.Format(time.RFC3339Nano),
+		RemoteAddr: e.RemoteAddr,
+		User:       e.User,
+		Method:     e.Method,
+		URI:        e.URI,
+		Proto:      e.Proto,
+		Host:       e.Host,
+		Status:     e.Status,
+		Bytes:      e.Bytes,
+		DurationMS: float64(e.Duration) / float64(time.Millisecond),
+		Referer:    e.Referer,
+		UserAgent:  e.UserAgent,
+		Route:      e.Route,
+		RequestID:  e.RequestID,
+	})
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func quoteEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`)
+}
+
+// w3cField makes a value safe for the space-separated W3C format.
+func w3cField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(s, " ", "+")
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"proxy/config"
@@ -36,9 +38,12 @@ func (l LogLevel) String() string {
 }
 
 type Logger struct {
-	writer io.Writer
-	level  LogLevel
+	level  atomic.Int32
 	format string
+
+	// mu serialises writes so concurrent entries never interleave.
+	mu     sync.Mutex
+	writer io.Writer
 }
 
 type LogEntry struct {
@@ -48,17 +53,42 @@ type LogEntry struct {
 	Fields    map[string]interface{} `json:"fields,omitempty"`
 }
 
+// NewLogger creates a logger writing to the configured output. If a log file
+// cannot be opened the logger falls back to stderr and reports why there.
 func NewLogger(cfg *config.LoggingConfig) *Logger {
-	level := parseLogLevel(cfg.Level)
+	level := ParseLogLevel(cfg.Level)
 
-	return &Logger{
+	logger := &Logger{
 		writer: os.Stdout,
-		level:  level,
 		format: cfg.Format,
 	}
+	logger.SetLevel(level)
+
+	switch cfg.Output {
+	case "", config.LogOutputStdout:
+	case config.LogOutputStderr:
+		logger.writer = os.Stderr
+	default:
+		file, err := OpenRotatingFile(cfg.Output, RotateOptions{
+			MaxBytes:   cfg.MaxBytes,
+			Interval:   time.Duration(cfg.RotateInterval),
+			MaxBackups: cfg.MaxBackups,
+		})
+		if err != nil {
+			logger.writer = os.Stderr
+			logger.Error("Failed to open log file, logging to stderr", map[string]interface{}{
+				"output": cfg.Output,
+				"error":  err.Error(),
+			})
+			break
+		}
+		logger.writer = file
+	}
+
+	return logger
 }
 
-func parseLogLevel(levelStr string) LogLevel {
+func ParseLogLevel(levelStr string) LogLevel {
 	switch strings.ToUpper(levelStr) {
 	case "DEBUG":
 		return DEBUG
@@ -90,7 +120,7 @@ func (l *Logger) Error(message string, fields map[string]interface{}) {
 }
 
 func (l *Logger) log(level LogLevel, message string, fields map[string]interface{}) {
-	if level < l.level {
+	if level < l.Level() {
 		return
 	}
 
@@ -121,13 +151,44 @@ func (l *Logger) log(level LogLevel, message string, fields map[string]interface
 		output = fmt.Sprintf("[%s] %s %s%s", entry.Timestamp, entry.Level, message, fieldsStr)
 	}
 
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	fmt.Fprintln(l.writer, output)
 }
 
 func (l *Logger) SetOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	l.writer = w
 }
 
+// Reopen reopens a log file output so that logging continues in a fresh file
+// after an external tool has rotated it. Other outputs are left alone.
+func (l *Logger) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.writer.(*RotatingFile); ok {
+		return f.Reopen()
+	}
+	return nil
+}
+
+// Close closes a log file output. Later entries are dropped.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.writer.(*RotatingFile); ok {
+		return f.Close()
+	}
+	return nil
+}
+
+// SetLevel changes the minimum level logged. It is safe to call while other
+// goroutines are logging.
 func (l *Logger) SetLevel(level LogLevel) {
-	l.level = level
+	l.level.Store(int32(level))
+}
+
+func (l *Logger) Level() LogLevel {
+	return LogLevel(l.level.Load())
 }
\ No newline at end of file
@@ -0,0 +1,288 @@
+package logging
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateOptions control when a RotatingFile starts a new file and what
+// happens to the old ones.
+type RotateOptions struct {
+	// MaxBytes rotates before a write would grow the file past this size.
+	MaxBytes int64
+	// Interval rotates once the current file has been open this long.
+	Interval time.Duration
+	// Compress gzips rotated files in the background.
+	Compress bool
+	// MaxBackups is how many rotated files to keep; 0 keeps them all.
+	MaxBackups int
+	// Header is written at the start of every new file.
+	Header []byte
+}
+
+// RotatingFile is an io.WriteCloser that appends to path and moves it aside
+// to path.<timestamp> (gzipped if requested) when it grows too large or too
+// old. Writes are serialised, so each Write call lands in the file intact.
+type RotatingFile struct {
+	path string
+	opts RotateOptions
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	compressing sync.WaitGroup
+}
+
+func OpenRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, opts: opts}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, size, err := f.openFile()
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.size = size
+	f.openedAt = time.Now()
+	return nil
+}
+
+// openFile opens path for appending, writing the header if the file is new.
+func (f *RotatingFile) openFile() (*os.File, int64, error) {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	size := info.Size()
+	if size == 0 && len(f.opts.Header) > 0 {
+		n, err := file.Write(f.opts.Header)
+		size += int64(n)
+		if err != nil {
+			file.Close()
+			return nil, 0, fmt.Errorf("failed to write log file header: %w", err)
+		}
+	}
+	return file, size, nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if f.due(int64(len(p))) {
+		// A failed rotation leaves the current file open, so the write
+		// still lands and rotation is tried again later.
+		if err := f.rotate(); err != nil && f.file == nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) due(next int64) bool {
+	headerOnly := f.size <= int64(len(f.opts.Header))
+	if headerOnly {
+		return false
+	}
+	if f.opts.MaxBytes > 0 && f.size+next > f.opts.MaxBytes {
+		return true
+	}
+	return f.opts.Interval > 0 && time.Since(f.openedAt) >= f.opts.Interval
+}
+
+// Rotate moves the current file aside and starts a new one.
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	return f.rotate()
+}
+
+// rotate moves the file aside and opens a new one. If that fails, logging
+// carries on in path, which is reopened for appending.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return f.recover(fmt.Errorf("failed to close log file: %w", err))
+	}
+	f.file = nil
+
+	rotated := f.rotatedName(time.Now())
+	if err := os.Rename(f.path, rotated); err != nil {
+		return f.recover(fmt.Errorf("failed to rotate log file: %w", err))
+	}
+
+	if f.opts.Compress {
+		f.compressing.Add(1)
+		go func() {
+			defer f.compressing.Done()
+			compressFile(rotated)
+			f.prune()
+		}()
+	} else {
+		f.prune()
+	}
+
+	if err := f.open(); err != nil {
+		return f.recover(err)
+	}
+	return nil
+}
+
+// recover reopens path after a failed rotation and returns err, joined with
+// the reopen error if there is one.
+func (f *RotatingFile) recover(err error) error {
+	if openErr := f.open(); openErr != nil {
+		f.file = nil
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// Reopen reopens path, for use after an external tool such as logrotate has
+// moved the file away. The old file stays in use if path cannot be opened.
+func (f *RotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+
+	file, size, err := f.openFile()
+	if err != nil {
+		return err
+	}
+	previous := f.file
+	f.file = file
+	f.size = size
+	f.openedAt = time.Now()
+
+	if err := previous.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	return nil
+}
+
+// prune removes the oldest rotated files beyond MaxBackups. A file and its
+// compressed copy count as one backup.
+func (f *RotatingFile) prune() {
+	if f.opts.MaxBackups <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+
+	files := make(map[string][]string)
+	var backups []string
+	for _, name := range matches {
+		base := strings.TrimSuffix(name, ".gz")
+		if _, ok := files[base]; !ok {
+			backups = append(backups, base)
+		}
+		files[base] = append(files[base], name)
+	}
+	if len(backups) <= f.opts.MaxBackups {
+		return
+	}
+
+	// Rotated names embed a sortable timestamp, so newest sorts last.
+	sort.Strings(backups)
+	for _, base := range backups[:len(backups)-f.opts.MaxBackups] {
+		for _, name := range files[base] {
+			os.Remove(name)
+		}
+	}
+}
+
+func (f *RotatingFile) rotatedName(now time.Time) string {
+	base := f.path + "." + now.Format("20060102-150405")
+	name := base
+	for i := 1; ; i++ {
+		_, err := os.Stat(name)
+		_, gzErr := os.Stat(name + ".gz")
+		if os.IsNotExist(err) && os.IsNotExist(gzErr) {
+			return name
+		}
+		name = base + "." + strconv.Itoa(i)
+	}
+}
+
+// Close closes the current file and waits for rotated files to finish
+// compressing.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.mu.Unlock()
+
+	f.compressing.Wait()
+	return err
+}
+
+// compressFile replaces path with path.gz. On failure the uncompressed file
+// is left in place.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -2,21 +2,36 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"proxy/config"
 	"proxy/logging"
 	"proxy/proxy"
+	"proxy/tlsutil"
 )
 
+// defaultCertReloadInterval is how often certificate files are checked for
+// changes when no reload interval is configured.
+const defaultCertReloadInterval = 30 * time.Second
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+
 	configPath := flag.String("config", "config/config.json", "Path to configuration file")
 	flag.Parse()
 
@@ -48,17 +63,37 @@ func main() {
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
-		Handler:      mux,
+		Handler:      handler.AccessLog(handler.ForwardProxy(mux)),
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
 
+	var certs *tlsutil.CertStore
+	if cfg.Server.TLS.Enabled {
+		server.TLSConfig, certs, err = tlsutil.NewServerConfig(&cfg.Server.TLS)
+		if err != nil {
+			logger.Error("Failed to load TLS certificates", map[string]interface{}{
+				"error": err.Error(),
+			})
+			os.Exit(1)
+		}
+		// A non-nil map keeps net/http from enabling HTTP/2.
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
 	go func() {
 		logger.Info("Server starting", map[string]interface{}{
 			"address": server.Addr,
+			"tls":     server.TLSConfig != nil,
 		})
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Error("Server failed to start", map[string]interface{}{
 				"error": err.Error(),
 			})
@@ -66,15 +101,59 @@ func main() {
 		}
 	}()
 
+	var redirect *http.Server
+	if port := cfg.Server.TLS.RedirectPort; cfg.Server.TLS.Enabled && port > 0 {
+		redirect = &http.Server{
+			Addr:         net.JoinHostPort(cfg.Server.Host, strconv.Itoa(port)),
+			Handler:      redirectToHTTPS(cfg.Server.Port),
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+		go func() {
+			logger.Info("HTTPS redirect server starting", map[string]interface{}{
+				"address": redirect.Addr,
+			})
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("HTTPS redirect server failed to start", map[string]interface{}{
+					"error": err.Error(),
+				})
+			}
+		}()
+	}
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	go watchConfig(watchCtx, *configPath, handler, logger)
+	go reopenLogs(watchCtx, handler, logger)
+	if certs != nil {
+		interval := time.Duration(cfg.Server.TLS.ReloadInterval)
+		if interval == 0 {
+			interval = defaultCertReloadInterval
+		}
+		go certs.Watch(watchCtx, interval, func(err error) {
+			if err != nil {
+				logger.Error("Failed to reload TLS certificates, keeping current ones", map[string]interface{}{
+					"error": err.Error(),
+				})
+				return
+			}
+			logger.Info("TLS certificates reloaded", nil)
+		})
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
+	stopWatching()
 	logger.Info("Shutting down server", nil)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
+
 	if err := server.Shutdown(ctx); err != nil {
 		logger.Error("Server forced to shutdown", map[string]interface{}{
 			"error": err.Error(),
@@ -82,7 +161,131 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := handler.Shutdown(ctx); err != nil {
+		logger.Warn("Failed to flush traces", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
 	logger.Info("Server exited", nil)
+	logger.Close()
+}
+
+// reopenLogs reopens log files on SIGUSR1 so external tools such as
+// logrotate can move them away.
+func reopenLogs(ctx context.Context, handler *proxy.Handler, logger *logging.Logger) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-usr1:
+			err := logger.Reopen()
+			if err == nil {
+				err = handler.ReopenLogs()
+			}
+			if err != nil {
+				logger.Error("Failed to reopen log files", map[string]interface{}{
+					"error": err.Error(),
+				})
+				continue
+			}
+			logger.Info("Log files reopened", nil)
+		}
+	}
+}
+
+// watchConfig reloads the configuration on SIGHUP and, when a poll interval
+// is configured, whenever the file changes on disk.
+func watchConfig(ctx context.Context, configPath string, handler *proxy.Handler, logger *logging.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	changed := make(chan struct{}, 1)
+	if interval := time.Duration(handler.Config().Server.ConfigPollInterval); interval > 0 {
+		go config.WatchFile(ctx, configPath, interval, func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reloadConfig(configPath, "SIGHUP", handler, logger)
+		case <-changed:
+			reloadConfig(configPath, "file changed", handler, logger)
+		}
+	}
+}
+
+func reloadConfig(configPath, trigger string, handler *proxy.Handler, logger *logging.Logger) {
+	previous := handler.Config()
+
+	cfg, err := config.LoadConfig(configPath)
+	if err == nil {
+		err = handler.Reload(cfg)
+	}
+	if err != nil {
+		logger.Error("Configuration reload failed, keeping current configuration", map[string]interface{}{
+			"trigger": trigger,
+			"config":  configPath,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	logger.SetLevel(logging.ParseLogLevel(cfg.Logging.Level))
+
+	if !reflect.DeepEqual(cfg.Server, previous.Server) {
+		logger.Warn("Server settings changed, restart required for them to take effect", map[string]interface{}{
+			"config": configPath,
+		})
+	}
+
+	logOutput, previousLogOutput := cfg.Logging, previous.Logging
+	logOutput.Level, previousLogOutput.Level = "", ""
+	if logOutput != previousLogOutput {
+		logger.Warn("Logging output changed, restart required for it to take effect", map[string]interface{}{
+			"config": configPath,
+		})
+	}
+
+	logger.Info("Configuration reloaded", map[string]interface{}{
+		"trigger": trigger,
+		"config":  configPath,
+	})
+}
+
+// redirectToHTTPS sends clients of the plain HTTP port to the same URL on
+// the HTTPS port.
+func redirectToHTTPS(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		// 308 keeps the method and body of non-GET requests.
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
 }
 
 func loadConfigWithFallback(configPath string) (*config.Config, error) {
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"proxy/config"
+	"proxy/logging"
+)
+
+type accessInfoKey struct{}
+
+// accessInfo carries details only the inner handler knows back out to the
+// access log middleware.
+type accessInfo struct {
+	route string
+	user  string
+	// bytes and status override the counted response size and status for
+	// hijacked connections.
+	bytes  int64
+	status int
+}
+
+// withAccessInfo makes sure r carries an accessInfo, even when the access
+// log middleware is not in use.
+func withAccessInfo(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(accessInfoKey{}).(*accessInfo); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), accessInfoKey{}, &accessInfo{}))
+}
+
+func accessInfoFrom(ctx context.Context) *accessInfo {
+	info, _ := ctx.Value(accessInfoKey{}).(*accessInfo)
+	if info == nil {
+		return &accessInfo{}
+	}
+	return info
+}
+
+func newAccessLogger(cfg *config.AccessLogConfig) (*logging.AccessLogger, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	return logging.NewAccessLogger(cfg)
+}
+
+// AccessLog writes every request handled by next to the configured access
+// log, if any.
+func (h *Handler) AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := h.acquire()
+		defer current.requests.release()
+		accessLog := current.accessLog
+		if accessLog == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		r = withRequestID(w, r)
+		info := &accessInfo{}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), accessInfoKey{}, info)))
+
+		status, bytes := sw.finalStatus(), sw.bytes
+		if sw.hijacked {
+			bytes = info.bytes
+			if info.status != 0 {
+				status = info.status
+			}
+		}
+
+		err := accessLog.Log(&logging.AccessEntry{
+			Time:       start,
+			RemoteAddr: clientIP(r),
+			User:       info.user,
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Proto:      r.Proto,
+			Host:       r.Host,
+			Status:     status,
+			Bytes:      bytes,
+			Duration:   time.Since(start),
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			Route:      info.route,
+			RequestID:  requestID(r.Context()),
+		})
+		if err != nil {
+			h.logger.Warn("Failed to write access log", map[string]interface{}{
+				"request_id": requestID(r.Context()),
+				"error":      err.Error(),
+			})
+		}
+	})
+}
+
+// ReopenLogs reopens the access log file after an external tool has
+// rotated it.
+func (h *Handler) ReopenLogs() error {
+	if accessLog := h.current.Load().accessLog; accessLog != nil {
+		return accessLog.Reopen()
+	}
+	return nil
+}
+
+// statusWriter records the status code and body size written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// finalStatus is the status the client saw: 200 for hijacked tunnels and
+// handlers that never called WriteHeader.
+func (w *statusWriter) finalStatus() int {
+	if w.hijacked || w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *statusWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
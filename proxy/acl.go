@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"net/netip"
+	"strings"
+
+	"proxy/config"
+)
+
+type hostRule struct {
+	host string
+	port int
+}
+
+func (r hostRule) matches(host string, port int) bool {
+	if r.port > 0 && r.port != port {
+		return false
+	}
+	return r.host == "*" || matchHost(r.host, host)
+}
+
+// HostACL decides which destinations clients may reach in forward proxy
+// mode. Denied hosts always win; an allowed host without an explicit port is
+// limited to the configured allowed ports. Rules match host names as given,
+// never the addresses they resolve to.
+type HostACL struct {
+	allow []hostRule
+	deny  []hostRule
+	ports map[int]bool
+}
+
+func NewHostACL(cfg *config.ForwardConfig) (*HostACL, error) {
+	acl := &HostACL{ports: make(map[int]bool)}
+
+	for _, pattern := range cfg.AllowedHosts {
+		host, port, err := config.ParseHostPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		acl.allow = append(acl.allow, hostRule{host: canonicalRuleHost(host), port: port})
+	}
+
+	for _, pattern := range cfg.DeniedHosts {
+		host, port, err := config.ParseHostPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		acl.deny = append(acl.deny, hostRule{host: canonicalRuleHost(host), port: port})
+	}
+
+	ports := cfg.AllowedPorts
+	if len(ports) == 0 {
+		ports = defaultForwardPorts
+	}
+	for _, port := range ports {
+		acl.ports[port] = true
+	}
+
+	return acl, nil
+}
+
+// Allowed reports whether clients may reach host on port. Different
+// spellings of the same host, such as a trailing dot or an IPv4-mapped IPv6
+// address, are judged as one.
+func (a *HostACL) Allowed(host string, port int) bool {
+	host, ok := canonicalHost(host)
+	if !ok {
+		return false
+	}
+
+	for _, rule := range a.deny {
+		if rule.matches(host, port) {
+			return false
+		}
+	}
+
+	for _, rule := range a.allow {
+		if !rule.matches(host, port) {
+			continue
+		}
+		if rule.port != 0 || a.ports[port] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canonicalHost lower-cases host, drops the trailing dot of a fully
+// qualified name and writes IP addresses in their plain form.
+func canonicalHost(host string) (string, bool) {
+	host = strings.TrimRight(strings.ToLower(host), ".")
+	if host == "" {
+		return "", false
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap().WithZone("").String(), true
+	}
+	return host, true
+}
+
+// canonicalRuleHost canonicalizes the host of a rule the way requests are,
+// leaving wildcards alone.
+func canonicalRuleHost(host string) string {
+	if host == "*" {
+		return host
+	}
+	if canonical, ok := canonicalHost(host); ok {
+		return canonical
+	}
+	return host
+}
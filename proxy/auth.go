@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"proxy/auth"
+	"proxy/config"
+)
+
+const (
+	defaultAPIKeyHeader = "X-API-Key"
+	defaultAuthRealm    = "proxy"
+)
+
+// inboundAuth checks who is calling. When only client certificates are
+// configured, identifying the caller is optional.
+type inboundAuth struct {
+	reverse      auth.Authenticator
+	forward      auth.Authenticator
+	required     bool
+	apiKeyHeader string
+	realm        string
+}
+
+func newInboundAuth(cfg *config.AuthConfig, clientCerts *config.ClientCertConfig) (*inboundAuth, error) {
+	certs := newClientCertAuth(clientCerts)
+	if !cfg.Enabled && certs == nil {
+		return nil, nil
+	}
+
+	a := &inboundAuth{
+		required:     cfg.Enabled,
+		apiKeyHeader: cfg.APIKeyHeader,
+		realm:        cfg.Realm,
+	}
+	if a.apiKeyHeader == "" {
+		a.apiKeyHeader = defaultAPIKeyHeader
+	}
+	if a.realm == "" {
+		a.realm = defaultAuthRealm
+	}
+
+	// A verified certificate identifies the caller before any credentials
+	// in headers are looked at.
+	var reverse, forward auth.Chain
+	if certs != nil {
+		reverse = append(reverse, certs)
+		forward = append(forward, certs)
+	}
+
+	if cfg.Enabled {
+		var users *auth.Htpasswd
+		if cfg.HtpasswdFile != "" {
+			var err error
+			if users, err = auth.LoadHtpasswd(cfg.HtpasswdFile); err != nil {
+				return nil, err
+			}
+		}
+
+		var apiKeys *auth.APIKeyAuthenticator
+		if len(cfg.APIKeys) > 0 {
+			keys := make(map[string]string, len(cfg.APIKeys))
+			for _, k := range cfg.APIKeys {
+				keys[k.Key] = k.Client
+			}
+			apiKeys = auth.NewAPIKeyAuthenticator(a.apiKeyHeader, keys)
+		}
+
+		if apiKeys != nil {
+			reverse = append(reverse, apiKeys)
+		}
+		if users != nil {
+			reverse = append(reverse, auth.NewBasicAuthenticator(users))
+		}
+		if users != nil || apiKeys != nil {
+			forward = append(forward, auth.NewProxyAuthenticator(users, apiKeys))
+		}
+	}
+	a.reverse = reverse
+	a.forward = forward
+
+	return a, nil
+}
+
+func isForwardRequest(r *http.Request) bool {
+	return r.Method == http.MethodConnect || r.URL.IsAbs()
+}
+
+// authenticate checks inbound credentials, answering 401 (or 407 for forward
+// proxy requests) when they are missing or wrong and authentication is
+// required. On success the identity is stored in the request context and our
+// own credentials are removed so they are never forwarded upstream.
+func (h *handler) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if h.auth == nil {
+		return r, true
+	}
+
+	forward := isForwardRequest(r) && h.config.Forward.Enabled
+	authenticator := h.auth.reverse
+	if forward {
+		authenticator = h.auth.forward
+	}
+
+	id, err := authenticator.Authenticate(r)
+	if err != nil && !h.auth.required {
+		return r, true
+	}
+	if err != nil {
+		h.rejectUnauthenticated(w, r, forward, err)
+		return nil, false
+	}
+
+	accessInfoFrom(r.Context()).user = id.Name
+	r = r.WithContext(auth.WithIdentity(r.Context(), id))
+	if h.auth.required {
+		r.Header.Del(h.auth.apiKeyHeader)
+	}
+	if id.Method == auth.MethodBasic {
+		r.Header.Del("Authorization")
+	}
+	return r, true
+}
+
+func (h *handler) rejectUnauthenticated(w http.ResponseWriter, r *http.Request, forward bool, err error) {
+	reason := "missing"
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		reason = "invalid"
+	}
+
+	mode := "reverse"
+	statusCode := http.StatusUnauthorized
+	challenge := "WWW-Authenticate"
+	if forward {
+		mode = "forward"
+		statusCode = http.StatusProxyAuthRequired
+		challenge = "Proxy-Authenticate"
+	}
+
+	h.metrics.authFailures.Inc(mode, reason)
+
+	h.logger.Warn("Authentication failed", map[string]interface{}{
+		"request_id": requestID(r.Context()),
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"host":       r.Host,
+		"mode":       mode,
+		"reason":     reason,
+		"remote_ip":  r.RemoteAddr,
+	})
+
+	w.Header().Set(challenge, fmt.Sprintf(`Basic realm=%q`, h.auth.realm))
+	writeError(w, r, statusCode, "Authentication required")
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// urlReplacer replaces the target's origin with the proxy's in everything
+// written through it. Bytes at the end of a write that could be the start of
+// a match are held back until the next write shows whether they are.
+type urlReplacer struct {
+	dst     io.Writer
+	old     [][]byte
+	new     [][]byte
+	maxLen  int
+	pending []byte
+}
+
+func newURLReplacer(dst io.Writer, rw *responseRewriter) *urlReplacer {
+	u := &urlReplacer{dst: dst}
+	add := func(old, new string) {
+		u.old = append(u.old, []byte(old))
+		u.new = append(u.new, []byte(new))
+		u.maxLen = max(u.maxLen, len(old))
+	}
+
+	// Absolute and protocol-relative URLs, plain and with the slashes
+	// escaped as they are in JSON and inline scripts.
+	for _, slashes := range []string{"//", `\/\/`} {
+		for _, scheme := range []string{"https:", "http:"} {
+			add(scheme+slashes+rw.targetHost, rw.publicScheme+":"+slashes+rw.publicHost)
+		}
+		add(slashes+rw.targetHost, slashes+rw.publicHost)
+	}
+	return u
+}
+
+func (u *urlReplacer) Write(p []byte) (int, error) {
+	u.pending = append(u.pending, p...)
+	out, rest := u.replace(u.pending, false)
+	u.pending = append([]byte(nil), rest...)
+	if _, err := u.dst.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes out anything still held back.
+func (u *urlReplacer) Close() error {
+	out, _ := u.replace(u.pending, true)
+	u.pending = nil
+	_, err := u.dst.Write(out)
+	return err
+}
+
+// replace returns buf with every match replaced, and the tail that has to
+// wait for more input unless this is the end of the body.
+func (u *urlReplacer) replace(buf []byte, final bool) ([]byte, []byte) {
+	var out []byte
+	for {
+		idx, k := u.next(buf)
+		if idx < 0 {
+			break
+		}
+		end := idx + len(u.old[k])
+		if end == len(buf) && !final {
+			// Whether this is the whole host depends on the next byte.
+			return append(out, buf[:idx]...), buf[idx:]
+		}
+		if end < len(buf) && isHostByte(buf[end]) {
+			// A longer host name or another port, such as
+			// target.example.org or target.example:8443.
+			out = append(out, buf[:idx+1]...)
+			buf = buf[idx+1:]
+			continue
+		}
+		out = append(out, buf[:idx]...)
+		out = append(out, u.new[k]...)
+		buf = buf[end:]
+	}
+
+	if final {
+		return append(out, buf...), nil
+	}
+	keep := u.partialMatch(buf)
+	return append(out, buf[:len(buf)-keep]...), buf[len(buf)-keep:]
+}
+
+// next finds the earliest match in buf, preferring the longest pattern when
+// several start at the same position.
+func (u *urlReplacer) next(buf []byte) (int, int) {
+	best, which := -1, -1
+	for k, old := range u.old {
+		i := bytes.Index(buf, old)
+		if i >= 0 && (best < 0 || i < best || i == best && len(old) > len(u.old[which])) {
+			best, which = i, k
+		}
+	}
+	return best, which
+}
+
+// partialMatch returns the length of the longest suffix of buf that is the
+// start of a pattern.
+func (u *urlReplacer) partialMatch(buf []byte) int {
+	for n := min(len(buf), u.maxLen-1); n > 0; n-- {
+		tail := buf[len(buf)-n:]
+		for _, old := range u.old {
+			if bytes.HasPrefix(old, tail) {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+func isHostByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == ':'
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// bodyRewriter decodes a compressed body written to it, rewrites it and
+// compresses it again on its way to dst. Each chunk is flushed through so
+// streamed responses keep flowing.
+type bodyRewriter struct {
+	pw   *io.PipeWriter
+	done chan error
+	err  error
+}
+
+// newBodyRewriter returns a writer that rewrites a body sent with the given
+// Content-Encoding, which must be one rewritesBody accepts. Close must be
+// called once the body has been written.
+func newBodyRewriter(dst io.Writer, encoding string, rw *responseRewriter) io.WriteCloser {
+	var encoder flushWriteCloser
+	var decode func(io.Reader) (io.Reader, error)
+	switch strings.ToLower(encoding) {
+	case "gzip":
+		encoder = gzip.NewWriter(dst)
+		decode = func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+	case "br":
+		encoder = brotli.NewWriter(dst)
+		decode = func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil }
+	default:
+		return newURLReplacer(dst, rw)
+	}
+
+	replacer := newURLReplacer(encoder, rw)
+	pr, pw := io.Pipe()
+	b := &bodyRewriter{pw: pw, done: make(chan error, 1)}
+
+	go func() {
+		var err error
+		defer func() {
+			// Unblock the writer if decoding stopped early.
+			pr.CloseWithError(err)
+			b.done <- err
+		}()
+
+		decoded, err := decode(pr)
+		if err == io.EOF {
+			// An empty body has no compressed stream at all.
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		buf := make([]byte, 32<<10)
+		for {
+			n, readErr := decoded.Read(buf)
+			if n > 0 {
+				if _, err = replacer.Write(buf[:n]); err != nil {
+					return
+				}
+				if err = encoder.Flush(); err != nil {
+					return
+				}
+			}
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil {
+				err = readErr
+				return
+			}
+		}
+
+		if err = replacer.Close(); err != nil {
+			return
+		}
+		err = encoder.Close()
+	}()
+
+	return b
+}
+
+func (b *bodyRewriter) Write(p []byte) (int, error) {
+	return b.pw.Write(p)
+}
+
+// Close ends the body and waits for the rewritten stream to be written out.
+func (b *bodyRewriter) Close() error {
+	if b.done == nil {
+		return b.err
+	}
+	b.pw.Close()
+	b.err = <-b.done
+	b.done = nil
+	return b.err
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+
+	"proxy/cache"
+	"proxy/config"
+)
+
+const (
+	defaultCacheMaxBytes      = 64 << 20
+	defaultCacheMaxEntryBytes = 4 << 20
+
+	cacheStatusHeader = "X-Cache"
+
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheRevalidated = "REVALIDATED"
+	cacheBypass      = "BYPASS"
+)
+
+func newCache(cfg *config.CacheConfig) (*cache.Cache, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	maxBytes := cfg.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultCacheMaxBytes
+	}
+
+	maxEntryBytes := cfg.MaxEntryBytes
+	if maxEntryBytes == 0 {
+		maxEntryBytes = defaultCacheMaxEntryBytes
+	}
+	if maxEntryBytes > maxBytes {
+		maxEntryBytes = maxBytes
+	}
+
+	var store cache.Store
+	if cfg.Backend == config.CacheBackendDisk {
+		disk, err := cache.NewDiskStore(cfg.Dir, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		store = disk
+	} else {
+		store = cache.NewMemoryStore(maxBytes)
+	}
+
+	return cache.New(store, maxEntryBytes), nil
+}
+
+// serveCached writes a stored response to the client, answering the
+// client's own conditional headers with 304 when they match.
+func (h *handler) serveCached(w http.ResponseWriter, r *http.Request, route *Route, entry *cache.Entry, result string, start time.Time, requestBody *captureBuffer) {
+	h.metrics.cacheRequests.Inc(result)
+
+	copyResponseHeaders(w, &http.Response{Header: entry.Header})
+	rewriter := newResponseRewriter(route, r)
+	if rewriter != nil {
+		rewriter.rewriteHeaders(w.Header())
+	}
+	route.responseHeaders.apply(w.Header(), r, route)
+	w.Header().Set("Age", strconv.Itoa(int(cache.Age(entry, time.Now()).Seconds())))
+	w.Header().Set(cacheStatusHeader, result)
+
+	statusCode := entry.StatusCode
+	var written int
+	if cache.NotModified(r, entry) {
+		statusCode = http.StatusNotModified
+		w.Header().Del("Content-Length")
+		w.WriteHeader(statusCode)
+	} else if rewriter != nil && rewriter.rewritesBody(r, statusCode, entry.Header) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(statusCode)
+		body := newBodyRewriter(w, entry.Header.Get("Content-Encoding"), rewriter)
+		_, err := body.Write(entry.Body)
+		if closeErr := body.Close(); err == nil && closeErr == nil {
+			written = len(entry.Body)
+		}
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(entry.Body)))
+		w.WriteHeader(statusCode)
+		written, _ = w.Write(entry.Body)
+	}
+
+	h.metrics.responseBytes.Add(float64(written), route.Name)
+	h.metrics.requests.Inc(r.Method, strconv.Itoa(statusCode), route.Name)
+
+	// Record the target's response as a miss would, not the rewritten one
+	// sent to the client.
+	if responseBody := h.captureResponseBody(entry.Header.Get("Content-Encoding")); responseBody != nil {
+		responseBody.Write(entry.Body[:written])
+		h.record(r, route, start, requestBody, statusCode, entry.Header, responseBody)
+	}
+
+	h.logger.Info("Request completed", map[string]interface{}{
+		"request_id":    requestID(r.Context()),
+		"method":        r.Method,
+		"path":          r.URL.Path,
+		"route":         route.Name,
+		"status_code":   statusCode,
+		"bytes_written": written,
+		"elapsed":       time.Since(start),
+		"content_type":  entry.Header.Get("Content-Type"),
+		"cache":         result,
+	})
+}
+
+// cacheBuffer collects a copy of the response body while it streams to the
+// client, giving up once the body outgrows the entry size limit.
+type cacheBuffer struct {
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (b *cacheBuffer) Write(p []byte) (int, error) {
+	if !b.overflow {
+		if int64(b.buf.Len()+len(p)) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -2,81 +2,280 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"time"
 
 	"proxy/config"
+	"proxy/logging"
+	"proxy/tracing"
 )
 
 type Client struct {
 	httpClient *http.Client
 	config     *config.Config
+	pool       *UpstreamPool
+	logger     *logging.Logger
+	metrics    *proxyMetrics
+	retry      *retryPolicy
+	hostLimit  *upstreamLimiter
+	tracer     *tracing.Tracer
+	forwarded  *forwardedPolicy
+	clientCert *clientCertHeader
+	targetTLS  map[string]*tls.Config
 }
 
-func NewClient(cfg *config.Config) (*Client, error) {
-	proxyURL, err := url.Parse(cfg.Proxy.URL)
+type upstreamContextKey struct{}
+
+func NewClient(cfg *config.Config, logger *logging.Logger) (*Client, error) {
+	pool, err := NewUpstreamPool(&cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	forwarded, err := newForwardedPolicy(&cfg.ForwardedHeaders)
 	if err != nil {
-		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		return nil, err
 	}
 
 	transport := &http.Transport{
 		Proxy: func(req *http.Request) (*url.URL, error) {
-			proxyURL.User = url.UserPassword(cfg.Proxy.Username, cfg.Proxy.Password)
-			return proxyURL, nil
+			upstream, ok := req.Context().Value(upstreamContextKey{}).(*Upstream)
+			if !ok {
+				upstream = pool.Next(nil)
+			}
+			if upstream.socks != nil {
+				// Never fall back to a direct connection.
+				return nil, fmt.Errorf("SOCKS upstream %s cannot be used as an HTTP proxy", upstream)
+			}
+			return upstream.URL(), nil
 		},
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 10,
-		IdleConnTimeout:     90 * time.Second,
-		TLSHandshakeTimeout: 10 * time.Second,
-		DisableCompression:  false,
-		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		DisableCompression:    false,
+		ResponseHeaderTimeout: upstreamTimeout(&cfg.Proxy),
+		ExpectContinueTimeout: 1 * time.Second,
 	}
 
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   30 * time.Second,
+	c := &Client{
+		config:     cfg,
+		pool:       pool,
+		logger:     logger,
+		retry:      newRetryPolicy(&cfg.Retry),
+		hostLimit:  newUpstreamLimiter(&cfg.RateLimit),
+		forwarded:  forwarded,
+		clientCert: newClientCertHeader(&cfg.Server.TLS.ClientCerts),
 	}
 
-	return &Client{
-		httpClient: client,
-		config:     cfg,
-	}, nil
+	targets, err := c.newTargetTransport(cfg, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	c.httpClient = &http.Client{
+		// No overall timeout: it would also cut off streamed bodies. The
+		// handler bounds each exchange instead.
+		Transport: targets,
+		// Redirects belong to the client; following them here would
+		// hide them and serve the wrong URL's content.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return c, nil
 }
 
-func (c *Client) ForwardRequest(ctx context.Context, originalReq *http.Request) (*http.Response, error) {
-	targetURL := fmt.Sprintf("%s://%s%s", c.config.Target.Scheme, c.config.Target.Host, originalReq.URL.Path)
-	if originalReq.URL.RawQuery != "" {
-		targetURL += "?" + originalReq.URL.RawQuery
+func (c *Client) ForwardRequest(ctx context.Context, originalReq *http.Request, route *Route) (*http.Response, error) {
+	targetURL := route.TargetURL(originalReq)
+	start := time.Now()
+
+	// Only idempotent (or explicitly opted-in) requests whose body fits in
+	// the replay buffer are retried.
+	attempts := 1
+	replay := false
+	var body *replayableBody
+	// Buffering the body up front would answer an "Expect: 100-continue"
+	// before the target has, so those requests are sent once.
+	expectContinue := headerContainsToken(originalReq.Header, "Expect", "100-continue")
+	if c.retry.methods[originalReq.Method] && !expectContinue {
+		buffered, ok, err := c.retry.prepareBody(originalReq)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			body = buffered
+			replay = true
+			attempts = c.retry.maxAttempts
+		}
+	}
+
+	tried := make(map[*Upstream]bool)
+	for attempt := 1; ; attempt++ {
+		if err := c.waitForHost(ctx, route.Target.Host); err != nil {
+			return nil, err
+		}
+
+		upstream := c.pool.Next(tried)
+		if upstream == nil {
+			tried = make(map[*Upstream]bool)
+			upstream = c.pool.Next(nil)
+		}
+		tried[upstream] = true
+
+		reqBody := originalReq.Body
+		contentLength := originalReq.ContentLength
+		if replay {
+			reqBody = body.reader()
+			contentLength = 0
+			if body != nil {
+				contentLength = int64(len(body.data))
+			}
+		}
+
+		req, err := http.NewRequestWithContext(context.WithValue(ctx, upstreamContextKey{}, upstream), originalReq.Method, targetURL, reqBody)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.ContentLength = contentLength
+		if len(originalReq.Trailer) > 0 {
+			// The map is filled in once the body has been read, so the
+			// trailers are sent after it; that needs a chunked body.
+			req.Trailer = originalReq.Trailer
+			req.ContentLength = -1
+		}
+
+		copyHeaders(req, originalReq)
+		c.forwarded.apply(req, originalReq)
+		c.clientCert.apply(req, originalReq)
+		if route.rewrite.Enabled && route.rewrite.Body {
+			limitAcceptEncoding(req.Header)
+		}
+		route.requestHeaders.apply(req.Header, originalReq, route)
+
+		spanCtx, span := c.startClientSpan(req.Context(), req, upstream, attempt)
+		if span != nil {
+			req = req.WithContext(spanCtx)
+			tracing.Inject(req.Header, span.SpanContext())
+		}
+
+		c.logger.Debug("Forwarding request", map[string]interface{}{
+			"request_id": requestID(ctx),
+			"attempt":    attempt,
+			"method":     originalReq.Method,
+			"url":        targetURL,
+			"upstream":   upstream.String(),
+		})
+
+		resp, err := c.httpClient.Do(req)
+		finishClientSpan(span, resp, err)
+		var reason string
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("proxy request failed: %w", err)
+			}
+			c.recordUpstreamFailure(ctx, upstream, err)
+			reason = err.Error()
+		case resp.StatusCode == http.StatusProxyAuthRequired:
+			c.recordUpstreamFailure(ctx, upstream, fmt.Errorf("upstream proxy rejected credentials: %s", resp.Status))
+			reason = resp.Status
+		default:
+			c.pool.MarkSuccess(upstream)
+			if !c.retry.retryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			reason = resp.Status
+		}
+
+		delay := c.retry.backoff(attempt)
+		if attempt >= attempts || time.Since(start)+delay > c.retry.budget {
+			if err != nil {
+				return nil, fmt.Errorf("proxy request failed: %w", err)
+			}
+			return resp, nil
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		c.logger.Warn("Retrying request", map[string]interface{}{
+			"request_id": requestID(ctx),
+			"attempt":    attempt,
+			"method":     originalReq.Method,
+			"url":        targetURL,
+			"upstream":   upstream.String(),
+			"reason":     reason,
+			"backoff":    delay,
+		})
+		if c.metrics != nil {
+			c.metrics.retries.Inc(route.Name)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("proxy request failed: %w", ctx.Err())
+		}
 	}
+}
 
-	req, err := http.NewRequestWithContext(ctx, originalReq.Method, targetURL, originalReq.Body)
+// waitForHost enforces the global per-target-host request rate, queueing for
+// up to the configured wait.
+func (c *Client) waitForHost(ctx context.Context, host string) error {
+	if c.hostLimit == nil {
+		return nil
+	}
+	retryAfter, ok, err := c.hostLimit.limiter.Wait(ctx, host, c.hostLimit.maxWait)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("proxy request failed: %w", err)
+	}
+	if !ok {
+		return &RateLimitError{Host: host, RetryAfter: retryAfter}
 	}
+	return nil
+}
 
-	copyHeaders(req, originalReq)
+func (c *Client) recordUpstreamFailure(ctx context.Context, upstream *Upstream, err error) {
+	if c.metrics != nil {
+		c.metrics.upstreamErrors.Inc(upstream.String())
+	}
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("proxy request failed: %w", err)
+	if c.pool.MarkFailure(upstream) {
+		c.logger.Warn("Upstream proxy marked unhealthy", map[string]interface{}{
+			"request_id": requestID(ctx),
+			"upstream":   upstream.String(),
+			"error":      err.Error(),
+		})
+		return
 	}
 
-	return resp, nil
+	c.logger.Debug("Upstream proxy attempt failed", map[string]interface{}{
+		"request_id": requestID(ctx),
+		"upstream":   upstream.String(),
+		"error":      err.Error(),
+	})
 }
 
 func copyHeaders(dst, src *http.Request) {
 	hopHeaders := map[string]bool{
 		"Connection":          true,
 		"Proxy-Connection":    true,
-		"Keep-Alive":         true,
-		"Proxy-Authenticate": true,
+		"Keep-Alive":          true,
+		"Proxy-Authenticate":  true,
 		"Proxy-Authorization": true,
-		"Te":                 true,
-		"Trailer":            true,
-		"Transfer-Encoding":  true,
-		"Upgrade":            true,
+		"Te":                  true,
+		"Trailer":             true,
+		"Transfer-Encoding":   true,
+		"Upgrade":             true,
 	}
 
 	for name, values := range src.Header {
@@ -87,10 +286,9 @@ func copyHeaders(dst, src *http.Request) {
 		}
 	}
 
-	dst.Header.Set("X-Forwarded-For", src.RemoteAddr)
-	dst.Header.Set("X-Forwarded-Proto", "http")
-	if src.Host != "" {
-		dst.Header.Set("X-Forwarded-Host", src.Host)
+	// "TE: trailers" is how gRPC and similar clients say they accept
+	// trailers; any other transfer codings are for this hop only.
+	if headerContainsToken(src.Header, "Te", "trailers") {
+		dst.Header.Set("Te", "trailers")
 	}
 }
-
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"proxy/auth"
+	"proxy/config"
+)
+
+const defaultClientCertIdentity = "common_name"
+
+var defaultClientCertFields = []string{"subject"}
+
+// clientCertField returns one of config.ClientCertFields from cert. Fields
+// with several values, such as SANs, are joined with commas.
+func clientCertField(cert *x509.Certificate, field string) string {
+	switch field {
+	case "common_name":
+		return cert.Subject.CommonName
+	case "subject":
+		return cert.Subject.String()
+	case "issuer":
+		return cert.Issuer.String()
+	case "serial":
+		return cert.SerialNumber.String()
+	case "fingerprint":
+		sum := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(sum[:])
+	case "dns":
+		return strings.Join(cert.DNSNames, ",")
+	case "email":
+		return strings.Join(cert.EmailAddresses, ",")
+	case "uri":
+		uris := make([]string, len(cert.URIs))
+		for i, u := range cert.URIs {
+			uris[i] = u.String()
+		}
+		return strings.Join(uris, ",")
+	case "not_after":
+		return cert.NotAfter.UTC().Format(time.RFC3339)
+	}
+	return ""
+}
+
+// newClientCertAuth names clients by the configured certificate field, or
+// nil when the listener does not ask for client certificates.
+func newClientCertAuth(cfg *config.ClientCertConfig) *auth.ClientCertAuthenticator {
+	if !cfg.Enabled() {
+		return nil
+	}
+	identity := cfg.Identity
+	if identity == "" {
+		identity = defaultClientCertIdentity
+	}
+	return auth.NewClientCertAuthenticator(func(cert *x509.Certificate) string {
+		if identity == "dns" || identity == "email" || identity == "uri" {
+			// Only the first SAN of the kind names the client.
+			name, _, _ := strings.Cut(clientCertField(cert, identity), ",")
+			return name
+		}
+		return clientCertField(cert, identity)
+	})
+}
+
+// clientCertHeader passes details of the client's verified certificate to
+// the target as field=value pairs, such as
+// `subject="CN=billing,O=Example";serial=4096`.
+type clientCertHeader struct {
+	name   string
+	fields []string
+}
+
+func newClientCertHeader(cfg *config.ClientCertConfig) *clientCertHeader {
+	if !cfg.Enabled() || cfg.Header == "" {
+		return nil
+	}
+	fields := cfg.Fields
+	if len(fields) == 0 {
+		fields = defaultClientCertFields
+	}
+	return &clientCertHeader{name: cfg.Header, fields: fields}
+}
+
+// apply sets the header on dst, the outbound copy of src. A value sent by
+// the client itself is always dropped so it cannot claim another identity.
+func (h *clientCertHeader) apply(dst, src *http.Request) {
+	if h == nil {
+		return
+	}
+	dst.Header.Del(h.name)
+
+	cert := auth.VerifiedClientCert(src)
+	if cert == nil {
+		return
+	}
+	pairs := make([]string, 0, len(h.fields))
+	for _, field := range h.fields {
+		if value := clientCertField(cert, field); value != "" {
+			pairs = append(pairs, field+"="+forwardedValue(value))
+		}
+	}
+	if len(pairs) > 0 {
+		dst.Header.Set(h.name, strings.Join(pairs, ";"))
+	}
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"proxy/config"
+)
+
+// tunnelRouteName and forwardRouteName label forward proxy traffic in logs
+// and metrics.
+const (
+	tunnelRouteName  = "tunnel"
+	forwardRouteName = "forward"
+)
+
+// connectTunnelKind and upgradeTunnelKind label open tunnels by how they
+// were opened.
+const (
+	connectTunnelKind = "connect"
+	upgradeTunnelKind = "upgrade"
+)
+
+var defaultForwardPorts = []int{80, 443}
+
+// ForwardProxy routes requests addressed to the server as a forward proxy
+// (CONNECT or an absolute request URI) to the handler and everything else to
+// next.
+func (h *Handler) ForwardProxy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect || r.URL.IsAbs() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardRoute builds a one-off route for an absolute-form request URI,
+// returning false if the destination is not allowed.
+func (h *handler) forwardRoute(r *http.Request) (*Route, bool) {
+	if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+		return nil, false
+	}
+
+	port := 80
+	if r.URL.Scheme == "https" {
+		port = 443
+	}
+	if p := r.URL.Port(); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		port = n
+	}
+
+	if !h.acl.Allowed(r.URL.Hostname(), port) {
+		return nil, false
+	}
+
+	return &Route{
+		Name:            forwardRouteName,
+		Target:          config.TargetConfig{Scheme: r.URL.Scheme, Host: r.URL.Host},
+		streaming:       h.config.Streaming,
+		requestHeaders:  h.router.fallback.requestHeaders,
+		responseHeaders: h.router.fallback.responseHeaders,
+	}, true
+}
+
+func (h *handler) serveConnect(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	addr := r.Host
+
+	h.logger.Info("Tunnel requested", map[string]interface{}{
+		"request_id": requestID(r.Context()),
+		"address":    addr,
+		"remote_ip":  r.RemoteAddr,
+	})
+
+	if !h.config.Forward.Enabled {
+		h.rejectConnect(w, r, http.StatusMethodNotAllowed, "Forward proxy mode is disabled")
+		return
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	port, perr := strconv.Atoi(portStr)
+	if err != nil || perr != nil || host == "" {
+		h.rejectConnect(w, r, http.StatusBadRequest, "Invalid CONNECT address")
+		return
+	}
+
+	if !h.acl.Allowed(host, port) {
+		h.rejectConnect(w, r, http.StatusForbidden, "Destination not allowed")
+		return
+	}
+
+	upstreamConn, upstream, err := h.client.DialTunnel(r.Context(), addr)
+	var limitErr *RateLimitError
+	if errors.As(err, &limitErr) {
+		h.rejectRateLimited(w, r, "upstream", limitErr.Host, tunnelRouteName, limitErr.RetryAfter)
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to open tunnel", map[string]interface{}{
+			"request_id": requestID(r.Context()),
+			"error":      err.Error(),
+			"address":    addr,
+			"elapsed":    time.Since(start),
+		})
+		h.rejectConnect(w, r, http.StatusBadGateway, "Proxy error")
+		return
+	}
+
+	clientConn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		upstreamConn.Close()
+		h.logger.Error("Failed to hijack connection", map[string]interface{}{
+			"request_id": requestID(r.Context()),
+			"error":      err.Error(),
+			"address":    addr,
+		})
+		h.rejectConnect(w, r, http.StatusInternalServerError, "Tunnelling not supported")
+		return
+	}
+
+	// The server's read and write timeouts must not apply to the tunnel.
+	clientConn.SetDeadline(time.Time{})
+
+	if _, err := rw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		clientConn.Close()
+		upstreamConn.Close()
+		return
+	}
+
+	var client net.Conn = clientConn
+	if rw.Reader.Buffered() > 0 {
+		client = &bufferedConn{Conn: clientConn, r: rw.Reader}
+	}
+
+	h.metrics.requests.Inc(r.Method, strconv.Itoa(http.StatusOK), tunnelRouteName)
+	h.metrics.inFlight.Inc()
+	defer h.metrics.inFlight.Dec()
+	h.metrics.openTunnels.Inc(connectTunnelKind)
+	defer h.metrics.openTunnels.Dec(connectTunnelKind)
+
+	idleTimeout := time.Duration(h.config.Forward.TunnelIdleTimeout)
+	if idleTimeout == 0 {
+		idleTimeout = defaultTunnelIdleTimeout
+	}
+
+	sent, received := splice(client, upstreamConn, idleTimeout)
+	accessInfoFrom(r.Context()).bytes = received
+	h.metrics.requestBytes.Add(float64(sent), tunnelRouteName)
+	h.metrics.responseBytes.Add(float64(received), tunnelRouteName)
+
+	h.logger.Info("Tunnel closed", map[string]interface{}{
+		"request_id":     requestID(r.Context()),
+		"address":        addr,
+		"upstream":       upstream.String(),
+		"bytes_sent":     sent,
+		"bytes_received": received,
+		"elapsed":        time.Since(start),
+	})
+}
+
+func (h *handler) rejectConnect(w http.ResponseWriter, r *http.Request, statusCode int, errorMsg string) {
+	h.metrics.requests.Inc(r.Method, strconv.Itoa(statusCode), tunnelRouteName)
+
+	h.logger.Warn("Tunnel rejected", map[string]interface{}{
+		"request_id":  requestID(r.Context()),
+		"address":     r.Host,
+		"status_code": statusCode,
+		"reason":      errorMsg,
+	})
+
+	writeError(w, r, statusCode, errorMsg)
+}
+
+func (h *handler) rejectForward(w http.ResponseWriter, r *http.Request) {
+	h.metrics.requests.Inc(r.Method, strconv.Itoa(http.StatusForbidden), forwardRouteName)
+
+	h.logger.Warn("Forward request rejected", map[string]interface{}{
+		"request_id": requestID(r.Context()),
+		"method":     r.Method,
+		"url":        r.URL.String(),
+		"remote_ip":  r.RemoteAddr,
+	})
+
+	writeError(w, r, http.StatusForbidden, "Destination not allowed")
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"proxy/config"
+)
+
+// forwardedPolicy writes the headers that tell the target who the original
+// client was, following config.ForwardedHeadersConfig.
+type forwardedPolicy struct {
+	xForwarded bool
+	forwarded  bool
+	trusted    []netip.Prefix
+}
+
+func newForwardedPolicy(cfg *config.ForwardedHeadersConfig) (*forwardedPolicy, error) {
+	p := &forwardedPolicy{}
+	switch cfg.Mode {
+	case "", config.ForwardedHeadersXForwarded:
+		p.xForwarded = true
+	case config.ForwardedHeadersRFC7239:
+		p.forwarded = true
+	case config.ForwardedHeadersBoth:
+		p.xForwarded = true
+		p.forwarded = true
+	}
+
+	for _, s := range cfg.TrustedProxies {
+		prefix, err := config.ParseTrustedProxy(s)
+		if err != nil {
+			return nil, err
+		}
+		p.trusted = append(p.trusted, prefix)
+	}
+	return p, nil
+}
+
+// trustedPeer reports whether r came straight from one of the trusted
+// proxies, whose forwarding headers are kept and extended.
+func (p *forwardedPolicy) trustedPeer(r *http.Request) bool {
+	addr, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the forwarding headers on dst, the outbound copy of src.
+func (p *forwardedPolicy) apply(dst, src *http.Request) {
+	trusted := p.trustedPeer(src)
+	if !trusted || !p.xForwarded {
+		dst.Header.Del("X-Forwarded-For")
+		dst.Header.Del("X-Forwarded-Proto")
+		dst.Header.Del("X-Forwarded-Host")
+	}
+	if !trusted || !p.forwarded {
+		dst.Header.Del("Forwarded")
+	}
+
+	ip := clientIP(src)
+	proto := "http"
+	if src.TLS != nil {
+		proto = "https"
+	}
+
+	if p.xForwarded {
+		// A trusted proxy in front of us knows better how the client
+		// originally connected.
+		appendHeader(dst.Header, "X-Forwarded-For", ip)
+		if dst.Header.Get("X-Forwarded-Proto") == "" {
+			dst.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if dst.Header.Get("X-Forwarded-Host") == "" && src.Host != "" {
+			dst.Header.Set("X-Forwarded-Host", src.Host)
+		}
+	}
+
+	if p.forwarded {
+		element := "for=" + forwardedNode(ip) + ";proto=" + proto
+		if src.Host != "" {
+			element += ";host=" + forwardedValue(src.Host)
+		}
+		appendHeader(dst.Header, "Forwarded", element)
+	}
+}
+
+// appendHeader adds value to the comma-separated list in the named header,
+// folding repeated header lines into one.
+func appendHeader(header http.Header, name, value string) {
+	if prior := header.Values(name); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	header.Set(name, value)
+}
+
+// forwardedNode formats an address for the Forwarded "for" parameter, which
+// needs IPv6 addresses bracketed and quoted (RFC 7239, section 6).
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return forwardedValue(ip)
+}
+
+// forwardedValue quotes v unless it is a plain token.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
@@ -2,103 +2,509 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"proxy/auth"
+	"proxy/cache"
 	"proxy/config"
 	"proxy/logging"
+	"proxy/tracing"
 )
 
+// Handler serves proxied requests using the configuration it was last
+// loaded or reloaded with. In-flight requests finish on the configuration
+// they started with.
 type Handler struct {
-	client *Client
-	logger *logging.Logger
-	config *config.Config
+	current atomic.Pointer[handler]
+	logger  *logging.Logger
+	metrics *proxyMetrics
+
+	reloadMu sync.Mutex
+}
+
+type handler struct {
+	client    *Client
+	router    *Router
+	logger    *logging.Logger
+	config    *config.Config
+	metrics   *proxyMetrics
+	cache     *cache.Cache
+	acl       *HostACL
+	auth      *inboundAuth
+	limiter   *clientLimiter
+	recorder  *exchangeRecorder
+	accessLog *logging.AccessLogger
+	tracer    *tracing.Tracer
+
+	requests drainGroup
+}
+
+// drainGroup counts the requests using a handler, so that a reload can close
+// the old handler's files once the last of them has finished.
+type drainGroup struct {
+	mu       sync.Mutex
+	n        int
+	draining bool
+	drained  chan struct{}
+}
+
+// add registers a request, returning false once the group is draining.
+func (g *drainGroup) add() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.draining {
+		return false
+	}
+	g.n++
+	return true
+}
+
+func (g *drainGroup) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n--
+	if g.draining && g.n == 0 {
+		close(g.drained)
+	}
+}
+
+// drain stops new requests from joining and returns a channel that is closed
+// when the last one has finished.
+func (g *drainGroup) drain() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.draining = true
+	g.drained = make(chan struct{})
+	if g.n == 0 {
+		close(g.drained)
+	}
+	return g.drained
 }
 
 func NewHandler(cfg *config.Config, logger *logging.Logger) (*Handler, error) {
-	if cfg.Proxy.URL == "" {
+	m := newProxyMetrics()
+	inner, err := newHandler(cfg, logger, m, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Handler{
+		logger:  logger,
+		metrics: m,
+	}
+	h.current.Store(inner)
+	return h, nil
+}
+
+// newHandler builds the configuration-dependent parts of the handler. State
+// that users would notice losing, such as cached responses and rate limit
+// buckets, is carried over from previous when its settings are unchanged.
+func newHandler(cfg *config.Config, logger *logging.Logger, m *proxyMetrics, previous *handler) (*handler, error) {
+	if len(cfg.Proxy.UpstreamList()) == 0 {
 		return nil, fmt.Errorf("proxy URL is required")
 	}
 
-	client, err := NewClient(cfg)
+	client, err := NewClient(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	client.metrics = m
+
+	acl, err := NewHostACL(&cfg.Forward)
+	if err != nil {
+		return nil, err
+	}
+
+	inbound, err := newInboundAuth(&cfg.Auth, &cfg.Server.TLS.ClientCerts)
+	if err != nil {
+		return nil, err
+	}
+
+	router, err := NewRouter(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Handler{
-		client: client,
-		logger: logger,
-		config: cfg,
+	var responseCache *cache.Cache
+	limiter := newClientLimiter(&cfg.RateLimit)
+	if previous != nil && previous.config.Cache == cfg.Cache {
+		responseCache = previous.cache
+	} else if responseCache, err = newCache(&cfg.Cache); err != nil {
+		return nil, err
+	}
+	if previous != nil && reflect.DeepEqual(previous.config.RateLimit, cfg.RateLimit) {
+		limiter = previous.limiter
+		client.hostLimit = previous.client.hostLimit
+	}
+
+	var recorder *exchangeRecorder
+	if previous != nil && reflect.DeepEqual(previous.config.Recording, cfg.Recording) && previous.config.Auth.APIKeyHeader == cfg.Auth.APIKeyHeader {
+		recorder = previous.recorder
+	} else if recorder, err = newExchangeRecorder(&cfg.Recording, &cfg.Auth); err != nil {
+		return nil, err
+	}
+
+	var tracer *tracing.Tracer
+	if previous != nil && reflect.DeepEqual(previous.config.Tracing, cfg.Tracing) {
+		tracer = previous.tracer
+	} else if tracer, err = newTracer(&cfg.Tracing, logger); err != nil {
+		return nil, err
+	}
+	client.tracer = tracer
+
+	var accessLog *logging.AccessLogger
+	if previous != nil && previous.config.AccessLog == cfg.AccessLog {
+		accessLog = previous.accessLog
+	} else if accessLog, err = newAccessLogger(&cfg.AccessLog); err != nil {
+		return nil, err
+	}
+
+	return &handler{
+		client:    client,
+		router:    router,
+		logger:    logger,
+		config:    cfg,
+		metrics:   m,
+		cache:     responseCache,
+		acl:       acl,
+		auth:      inbound,
+		limiter:   limiter,
+		recorder:  recorder,
+		accessLog: accessLog,
+		tracer:    tracer,
 	}, nil
 }
 
+// Reload atomically switches to cfg, which must already be validated. On
+// error the current configuration stays in place. Client certificate
+// settings cannot change: the listener asks for certificates as configured
+// at startup, and authentication must agree with it.
+func (h *Handler) Reload(cfg *config.Config) error {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+
+	previous := h.current.Load()
+	if !reflect.DeepEqual(cfg.Server.TLS.ClientCerts, previous.config.Server.TLS.ClientCerts) {
+		return fmt.Errorf("client certificate settings changed, restart required for them to take effect")
+	}
+
+	next, err := newHandler(cfg, h.logger, h.metrics, previous)
+	if err != nil {
+		return err
+	}
+
+	h.current.Store(next)
+	previous.client.httpClient.CloseIdleConnections()
+
+	// Requests still running on previous may yet record, log or export
+	// spans, so its sinks are closed once they have all finished.
+	drained := previous.requests.drain()
+	go func() {
+		<-drained
+		if previous.recorder != nil && previous.recorder != next.recorder {
+			previous.recorder.recorder.Close()
+		}
+		if previous.accessLog != nil && previous.accessLog != next.accessLog {
+			previous.accessLog.Close()
+		}
+		if previous.tracer != next.tracer {
+			previous.tracer.Shutdown(context.Background())
+		}
+	}()
+	return nil
+}
+
+// acquire returns the current handler, which stays open until the caller
+// releases it.
+func (h *Handler) acquire() *handler {
+	for {
+		// A handler only drains after it has been replaced, so the next
+		// load finds its successor.
+		if current := h.current.Load(); current.requests.add() {
+			return current
+		}
+	}
+}
+
+// Shutdown flushes spans still waiting to be exported and closes the
+// recording and access log files.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	current := h.current.Load()
+	err := current.tracer.Shutdown(ctx)
+	if current.recorder != nil {
+		current.recorder.recorder.Close()
+	}
+	if current.accessLog != nil {
+		current.accessLog.Close()
+	}
+	return err
+}
+
+func (h *Handler) Config() *config.Config {
+	return h.current.Load().config
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	current := h.acquire()
+	defer current.requests.release()
+	current.ServeHTTP(w, withRequestID(w, r))
+}
+
+func (h *Handler) HealthCheck(w http.ResponseWriter, r *http.Request) {
+	h.current.Load().HealthCheck(w, r)
+}
+
+func (h *Handler) Metrics(w http.ResponseWriter, r *http.Request) {
+	h.current.Load().Metrics(w, r)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withAccessInfo(r)
+	r, span := h.startServerSpan(r)
+	if span == nil {
+		h.serve(w, r)
+		return
+	}
+
+	sw := &statusWriter{ResponseWriter: w}
+	h.serve(sw, r)
+	status := sw.finalStatus()
+	if info := accessInfoFrom(r.Context()); sw.hijacked && info.status != 0 {
+		status = info.status
+	}
+	finishServerSpan(span, r, status)
+}
+
+func (h *handler) serve(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	info := accessInfoFrom(r.Context())
+	if r.Method == http.MethodConnect {
+		info.route = tunnelRouteName
+		if h.allowRequest(w, r, tunnelRouteName) {
+			h.serveConnect(w, r)
+		}
+		return
+	}
+
 	start := time.Now()
+	route := h.router.Match(r)
+	if r.URL.IsAbs() && h.config.Forward.Enabled {
+		if route, ok = h.forwardRoute(r); !ok {
+			h.rejectForward(w, r)
+			return
+		}
+	}
 
-	h.logger.Info("Request received", map[string]interface{}{
+	info.route = route.Name
+	if !h.allowRequest(w, r, route.Name) {
+		return
+	}
+
+	h.metrics.inFlight.Inc()
+	defer h.metrics.inFlight.Dec()
+
+	if isUpgradeRequest(r) {
+		h.serveUpgrade(w, r, route, start)
+		return
+	}
+
+	var body *countingReader
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		defer func() {
+			h.metrics.requestBytes.Add(float64(body.n), route.Name)
+		}()
+	}
+	requestBody := h.captureRequestBody(r)
+
+	received := map[string]interface{}{
+		"request_id": requestID(r.Context()),
 		"method":     r.Method,
 		"path":       r.URL.Path,
+		"route":      route.Name,
 		"query":      r.URL.RawQuery,
 		"user_agent": r.Header.Get("User-Agent"),
 		"remote_ip":  r.RemoteAddr,
-	})
+	}
+	if id, ok := auth.FromContext(r.Context()); ok {
+		received["client"] = id.Name
+	}
+	h.logger.Info("Request received", received)
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
-	defer cancel()
+	outReq := r
+	var cacheKey, cacheResult string
+	var cached *cache.Entry
+	if h.cache != nil {
+		cacheResult = cacheBypass
+		if cache.Cacheable(r) {
+			cacheKey = route.TargetURL(r)
+			cacheResult = cacheMiss
+
+			entry, status := h.cache.Lookup(cacheKey, r, start)
+			if status == cache.Fresh {
+				h.serveCached(w, r, route, entry, cacheHit, start, requestBody)
+				return
+			}
+			// A stale entry is revalidated with our own conditional request
+			// unless the client already sent one, whose 304 must reach it.
+			if status == cache.Stale && !cache.HasConditionalHeaders(r.Header) {
+				revalidation := r.Clone(r.Context())
+				if cache.SetConditionalHeaders(revalidation.Header, entry) {
+					outReq = revalidation
+					cached = entry
+				}
+			}
+		}
+	}
+
+	// The upstream deadline covers the whole exchange, except that a
+	// streamed response runs on for as long as bytes keep flowing.
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	deadline := time.AfterFunc(upstreamTimeout(&h.config.Proxy), func() { cancel(errUpstreamTimeout) })
+	defer deadline.Stop()
+	timedOut := func() bool { return errors.Is(context.Cause(ctx), errUpstreamTimeout) }
 
-	resp, err := h.client.ForwardRequest(ctx, r)
+	resp, err := h.client.ForwardRequest(withInformational(ctx, r, w), outReq, route)
+	h.metrics.upstreamDuration.Observe(time.Since(start).Seconds(), route.Name)
 	if err != nil {
+		var limitErr *RateLimitError
+		if errors.As(err, &limitErr) {
+			h.rejectRateLimited(w, r, "upstream", limitErr.Host, route.Name, limitErr.RetryAfter)
+			return
+		}
+
 		statusCode := http.StatusBadGateway
 		errorMsg := "Proxy error"
 
-		if ctx.Err() == context.DeadlineExceeded {
+		if timedOut() {
 			statusCode = http.StatusGatewayTimeout
 			errorMsg = "Request timeout"
+			h.metrics.timeouts.Inc(route.Name)
 		}
+		h.metrics.requests.Inc(r.Method, strconv.Itoa(statusCode), route.Name)
 
 		h.logger.Error("Failed to forward request", map[string]interface{}{
+			"request_id":  requestID(r.Context()),
 			"error":       err.Error(),
 			"path":        r.URL.Path,
 			"method":      r.Method,
+			"route":       route.Name,
 			"elapsed":     time.Since(start),
 			"status_code": statusCode,
-			"timeout":     ctx.Err() == context.DeadlineExceeded,
+			"timeout":     timedOut(),
 		})
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(statusCode)
-		w.Write([]byte(fmt.Sprintf(`{"error":"%s","timestamp":"%s"}`, errorMsg, time.Now().Format(time.RFC3339))))
+		writeError(w, r, statusCode, errorMsg)
 		return
 	}
 	defer resp.Body.Close()
 
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		entry := h.cache.Revalidated(cached, resp, start, time.Now())
+		h.serveCached(w, r, route, entry, cacheRevalidated, start, requestBody)
+		return
+	}
+
 	copyResponseHeaders(w, resp)
+	rewriter := newResponseRewriter(route, r)
+	rewriteBody := false
+	if rewriter != nil {
+		rewriter.rewriteHeaders(w.Header())
+		if rewriteBody = rewriter.rewritesBody(r, resp.StatusCode, resp.Header); rewriteBody {
+			w.Header().Del("Content-Length")
+		}
+	}
+	route.responseHeaders.apply(w.Header(), r, route)
+	if cacheResult != "" {
+		h.metrics.cacheRequests.Inc(cacheResult)
+		w.Header().Set(cacheStatusHeader, cacheResult)
+	}
+	announced := announceTrailers(w, resp)
 	w.WriteHeader(resp.StatusCode)
+	if announced > 0 {
+		// Flush now so net/http sends the body chunked, which trailers
+		// need, rather than buffering a short body to set Content-Length.
+		http.NewResponseController(w).Flush()
+	}
+
+	writers := []io.Writer{w}
+	if isStreaming(r, resp) {
+		var stream *streamWriter
+		stream = newStreamWriter(w, resp, route, func() { deadline.Reset(stream.writeTimeout) })
+		defer stream.Close()
+		deadline.Reset(stream.writeTimeout)
+		writers[0] = stream
+	}
+	var rewritten io.WriteCloser
+	if rewriteBody {
+		rewritten = newBodyRewriter(writers[0], resp.Header.Get("Content-Encoding"), rewriter)
+		defer rewritten.Close()
+		writers[0] = rewritten
+	}
+	var buffer *cacheBuffer
+	if cacheKey != "" && resp.ContentLength <= h.cache.MaxEntryBytes() && cache.Storable(r, resp) {
+		buffer = &cacheBuffer{limit: h.cache.MaxEntryBytes()}
+		writers = append(writers, buffer)
+	}
+	responseBody := h.captureResponseBody(resp.Header.Get("Content-Encoding"))
+	if responseBody != nil {
+		defer responseBody.finish()
+		writers = append(writers, responseBody)
+	}
 
-	written, err := io.Copy(w, resp.Body)
+	written, err := io.Copy(io.MultiWriter(writers...), resp.Body)
+	if err == nil && rewritten != nil {
+		err = rewritten.Close()
+	}
+	h.metrics.responseBytes.Add(float64(written), route.Name)
+	h.metrics.requests.Inc(r.Method, strconv.Itoa(resp.StatusCode), route.Name)
 	if err != nil {
 		h.logger.Error("Failed to copy response body", map[string]interface{}{
-			"error":   err.Error(),
-			"path":    r.URL.Path,
-			"method":  r.Method,
-			"elapsed": time.Since(start),
+			"request_id": requestID(r.Context()),
+			"error":      err.Error(),
+			"path":       r.URL.Path,
+			"method":     r.Method,
+			"elapsed":    time.Since(start),
+			"timeout":    timedOut(),
 		})
 		return
 	}
 
+	copyTrailers(w, resp, announced)
+
+	if buffer != nil && !buffer.overflow && len(resp.Trailer) == 0 {
+		h.cache.Store(cacheKey, r, resp, buffer.buf.Bytes(), start, time.Now())
+	}
+	h.record(r, route, start, requestBody, resp.StatusCode, resp.Header, responseBody)
+
 	h.logger.Info("Request completed", map[string]interface{}{
-		"method":       r.Method,
-		"path":         r.URL.Path,
-		"status_code":  resp.StatusCode,
+		"request_id":    requestID(r.Context()),
+		"method":        r.Method,
+		"path":          r.URL.Path,
+		"route":         route.Name,
+		"status_code":   resp.StatusCode,
 		"bytes_written": written,
-		"elapsed":      time.Since(start),
-		"content_type": resp.Header.Get("Content-Type"),
+		"elapsed":       time.Since(start),
+		"content_type":  resp.Header.Get("Content-Type"),
+		"cache":         cacheResult,
 	})
 }
 
-func (h *Handler) HealthCheck(w http.ResponseWriter, r *http.Request) {
+func (h *handler) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -130,35 +536,44 @@ func (h *Handler) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"status":"healthy","timestamp":"` + time.Now().Format(time.RFC3339) + `"}`))
 }
 
-func (h *Handler) Metrics(w http.ResponseWriter, r *http.Request) {
+func (h *handler) Metrics(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	if wantsPrometheus(r) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		h.metrics.registry.WritePrometheus(w)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"metrics":{"uptime":"` + time.Since(time.Now()).String() + `","requests_total":0}}`))
+	h.metrics.writeJSON(w)
 }
 
 func copyResponseHeaders(dst http.ResponseWriter, src *http.Response) {
 	hopHeaders := map[string]bool{
-		"Connection":        true,
-		"Proxy-Connection":  true,
-		"Keep-Alive":       true,
-		"Proxy-Authenticate": true,
+		"Connection":          true,
+		"Proxy-Connection":    true,
+		"Keep-Alive":          true,
+		"Proxy-Authenticate":  true,
 		"Proxy-Authorization": true,
-		"Te":               true,
-		"Trailer":          true,
-		"Transfer-Encoding": true,
-		"Upgrade":          true,
+		"Te":                  true,
+		"Trailer":             true,
+		"Transfer-Encoding":   true,
+		"Upgrade":             true,
 	}
 
 	for name, values := range src.Header {
-		if !hopHeaders[name] {
+		// Our own request ID is already set and must not be doubled up by
+		// an upstream echoing it back.
+		if !hopHeaders[name] && name != requestIDHeader {
 			for _, value := range values {
 				dst.Header().Add(name, value)
 			}
 		}
 	}
-}
\ No newline at end of file
+}
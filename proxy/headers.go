@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"proxy/config"
+)
+
+var headerVariable = regexp.MustCompile(`\$\{(\w+)\}`)
+
+type headerRule struct {
+	action  string
+	name    string
+	value   string
+	pattern *regexp.Regexp
+}
+
+// headerRules applies the configured header rules in order.
+type headerRules []headerRule
+
+func compileHeaderRules(lists ...[]config.HeaderRule) (headerRules, error) {
+	var rules headerRules
+	for _, list := range lists {
+		for _, rc := range list {
+			rule := headerRule{
+				action: rc.Action,
+				name:   http.CanonicalHeaderKey(rc.Name),
+				value:  rc.Value,
+			}
+			if rc.Action == config.HeaderActionReplace {
+				pattern, err := regexp.Compile(rc.Pattern)
+				if err != nil {
+					return nil, fmt.Errorf("invalid header rule pattern %q: %w", rc.Pattern, err)
+				}
+				rule.pattern = pattern
+			}
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// apply runs the rules against header, filling in variables from r, the
+// inbound request, and route.
+func (rules headerRules) apply(header http.Header, r *http.Request, route *Route) {
+	if len(rules) == 0 {
+		return
+	}
+
+	vars := map[string]string{
+		"client_ip":   clientIP(r),
+		"request_id":  requestID(r.Context()),
+		"target_host": route.Target.Host,
+		"route":       route.Name,
+		"host":        r.Host,
+		"method":      r.Method,
+		"path":        r.URL.Path,
+	}
+
+	for _, rule := range rules {
+		switch rule.action {
+		case config.HeaderActionAdd:
+			header.Add(rule.name, expandHeaderValue(rule.value, vars, false))
+		case config.HeaderActionSet:
+			header.Set(rule.name, expandHeaderValue(rule.value, vars, false))
+		case config.HeaderActionRemove:
+			header.Del(rule.name)
+		case config.HeaderActionReplace:
+			values := header.Values(rule.name)
+			if len(values) == 0 {
+				continue
+			}
+			replacement := expandHeaderValue(rule.value, vars, true)
+			replaced := make([]string, len(values))
+			for i, value := range values {
+				replaced[i] = rule.pattern.ReplaceAllString(value, replacement)
+			}
+			header[rule.name] = replaced
+		}
+	}
+}
+
+// expandHeaderValue substitutes ${name} variables, leaving anything else,
+// such as ${1} capture group references, alone. In a regexp replacement the
+// substituted values have their "$" escaped so they are taken literally.
+func expandHeaderValue(value string, vars map[string]string, replacement bool) string {
+	return headerVariable.ReplaceAllStringFunc(value, func(match string) string {
+		v, ok := vars[match[2:len(match)-1]]
+		if !ok {
+			return match
+		}
+		if replacement {
+			v = strings.ReplaceAll(v, "$", "$$")
+		}
+		return v
+	})
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"proxy/metrics"
+)
+
+type proxyMetrics struct {
+	registry  *metrics.Registry
+	startTime time.Time
+
+	requests         *metrics.CounterVec
+	upstreamDuration *metrics.HistogramVec
+	requestBytes     *metrics.CounterVec
+	responseBytes    *metrics.CounterVec
+	upstreamErrors   *metrics.CounterVec
+	timeouts         *metrics.CounterVec
+	inFlight         *metrics.GaugeVec
+	openTunnels      *metrics.GaugeVec
+	cacheRequests    *metrics.CounterVec
+	retries          *metrics.CounterVec
+	authFailures     *metrics.CounterVec
+	rateLimited      *metrics.CounterVec
+	pinFailures      *metrics.CounterVec
+}
+
+func newProxyMetrics() *proxyMetrics {
+	registry := metrics.NewRegistry()
+	startTime := time.Now()
+
+	m := &proxyMetrics{
+		registry:  registry,
+		startTime: startTime,
+	}
+
+	registry.NewGaugeFunc("proxy_uptime_seconds", "Seconds since the proxy server started.", func() float64 {
+		return time.Since(startTime).Seconds()
+	})
+	m.requests = registry.NewCounterVec("proxy_requests_total", "Proxied requests by method, status code and route.", "method", "status", "route")
+	m.upstreamDuration = registry.NewHistogramVec("proxy_upstream_duration_seconds", "Time until the upstream response headers were received.", nil, "route")
+	m.requestBytes = registry.NewCounterVec("proxy_request_bytes_total", "Request body bytes received from clients.", "route")
+	m.responseBytes = registry.NewCounterVec("proxy_response_bytes_total", "Response body bytes sent to clients.", "route")
+	m.upstreamErrors = registry.NewCounterVec("proxy_upstream_errors_total", "Failed attempts through an upstream proxy.", "upstream")
+	m.timeouts = registry.NewCounterVec("proxy_timeouts_total", "Requests that hit the upstream timeout.", "route")
+	m.inFlight = registry.NewGaugeVec("proxy_requests_in_flight", "Requests currently being proxied.")
+	m.openTunnels = registry.NewGaugeVec("proxy_open_tunnels", "CONNECT and Upgrade tunnels currently open, by kind.", "kind")
+	m.retries = registry.NewCounterVec("proxy_upstream_retries_total", "Upstream requests retried after a failed attempt.", "route")
+	m.cacheRequests = registry.NewCounterVec("proxy_cache_requests_total", "Response cache lookups by result.", "result")
+	m.rateLimited = registry.NewCounterVec("proxy_rate_limited_total", "Requests rejected by rate limiting, by client or upstream scope.", "scope")
+	m.authFailures = registry.NewCounterVec("proxy_auth_failures_total", "Inbound requests rejected for missing or invalid credentials.", "mode", "reason")
+	m.pinFailures = registry.NewCounterVec("proxy_tls_pin_failures_total", "TLS handshakes with targets whose certificate chain matched no pinned key.", "target")
+
+	return m
+}
+
+func (m *proxyMetrics) writeJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"metrics": map[string]interface{}{
+			"uptime":                time.Since(m.startTime).String(),
+			"requests_total":        m.requests.Total(),
+			"requests_in_flight":    m.inFlight.Total(),
+			"open_tunnels":          m.openTunnels.Total(),
+			"request_bytes_total":   m.requestBytes.Total(),
+			"response_bytes_total":  m.responseBytes.Total(),
+			"upstream_errors_total": m.upstreamErrors.Total(),
+			"timeouts_total":        m.timeouts.Total(),
+			"auth_failures_total":   m.authFailures.Total(),
+			"rate_limited_total":    m.rateLimited.Total(),
+			"pin_failures_total":    m.pinFailures.Total(),
+			"cache_hits_total":      m.cacheRequests.Value(cacheHit) + m.cacheRequests.Value(cacheRevalidated),
+		},
+	})
+}
+
+// wantsPrometheus reports whether the scraper asked for the text exposition
+// format. Plain requests keep getting the JSON view.
+func wantsPrometheus(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "prometheus":
+		return true
+	case "json":
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") || strings.Contains(accept, "application/openmetrics-text")
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
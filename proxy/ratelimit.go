@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"proxy/auth"
+	"proxy/config"
+	"proxy/ratelimit"
+)
+
+// RateLimitError is returned by the client when the per-host upstream limit
+// would have to be waited on for longer than allowed.
+type RateLimitError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("upstream rate limit exceeded for %s", e.Host)
+}
+
+type upstreamLimiter struct {
+	limiter *ratelimit.Limiter
+	maxWait time.Duration
+}
+
+func newUpstreamLimiter(cfg *config.RateLimitConfig) *upstreamLimiter {
+	if !cfg.Enabled || cfg.Upstream.RequestsPerSecond <= 0 {
+		return nil
+	}
+	return &upstreamLimiter{
+		limiter: ratelimit.New(cfg.Upstream.RequestsPerSecond, cfg.Upstream.Burst),
+		maxWait: time.Duration(cfg.Upstream.MaxWait),
+	}
+}
+
+type clientLimiter struct {
+	limiter *ratelimit.Limiter
+	key     string
+	maxWait time.Duration
+}
+
+func newClientLimiter(cfg *config.RateLimitConfig) *clientLimiter {
+	if !cfg.Enabled || cfg.RequestsPerSecond <= 0 {
+		return nil
+	}
+	key := cfg.Key
+	if key == "" {
+		key = config.RateLimitKeyIP
+	}
+	return &clientLimiter{
+		limiter: ratelimit.New(cfg.RequestsPerSecond, cfg.Burst),
+		key:     key,
+		maxWait: time.Duration(cfg.MaxWait),
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (l *clientLimiter) keyFor(r *http.Request, routeName string) string {
+	switch l.key {
+	case config.RateLimitKeyRoute:
+		return "route:" + routeName
+	case config.RateLimitKeyAPIKey:
+		// Unauthenticated callers fall back to their address.
+		if id, ok := auth.FromContext(r.Context()); ok {
+			return "client:" + id.Name
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// allowRequest applies the per-client limit, queueing for up to the
+// configured wait and otherwise answering 429 with Retry-After.
+func (h *handler) allowRequest(w http.ResponseWriter, r *http.Request, routeName string) bool {
+	if h.limiter == nil {
+		return true
+	}
+
+	key := h.limiter.keyFor(r, routeName)
+	retryAfter, ok, err := h.limiter.limiter.Wait(r.Context(), key, h.limiter.maxWait)
+	if ok {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+
+	h.rejectRateLimited(w, r, "client", key, routeName, retryAfter)
+	return false
+}
+
+func (h *handler) rejectRateLimited(w http.ResponseWriter, r *http.Request, scope, key, routeName string, retryAfter time.Duration) {
+	h.metrics.rateLimited.Inc(scope)
+	h.metrics.requests.Inc(r.Method, strconv.Itoa(http.StatusTooManyRequests), routeName)
+
+	h.logger.Warn("Rate limit exceeded", map[string]interface{}{
+		"request_id":  requestID(r.Context()),
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"route":       routeName,
+		"scope":       scope,
+		"key":         key,
+		"retry_after": retryAfter,
+	})
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, r, http.StatusTooManyRequests, "Rate limit exceeded")
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+
+	"proxy/config"
+	"proxy/recording"
+)
+
+const (
+	defaultRecordingFile         = "recordings.jsonl"
+	defaultRecordingMaxBodyBytes = 64 << 10
+)
+
+type exchangeRecorder struct {
+	recorder     *recording.Recorder
+	maxBodyBytes int64
+}
+
+func newExchangeRecorder(cfg *config.RecordingConfig, authCfg *config.AuthConfig) (*exchangeRecorder, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	// API keys are credentials whether or not inbound auth is enabled.
+	apiKeyHeader := authCfg.APIKeyHeader
+	if apiKeyHeader == "" {
+		apiKeyHeader = defaultAPIKeyHeader
+	}
+	headers := append([]string{apiKeyHeader}, cfg.RedactHeaders...)
+
+	redactor, err := recording.NewRedactor(headers, cfg.RedactQuery, cfg.RedactPatterns)
+	if err != nil {
+		return nil, err
+	}
+
+	path := cfg.File
+	if path == "" {
+		path = defaultRecordingFile
+	}
+	recorder, err := recording.Open(path, redactor)
+	if err != nil {
+		return nil, err
+	}
+
+	maxBodyBytes := cfg.MaxBodyBytes
+	if maxBodyBytes == 0 {
+		maxBodyBytes = defaultRecordingMaxBodyBytes
+	}
+
+	return &exchangeRecorder{recorder: recorder, maxBodyBytes: maxBodyBytes}, nil
+}
+
+// captureBuffer keeps the first limit bytes written to it and notes whether
+// anything was cut off.
+type captureBuffer struct {
+	buf       bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - int64(b.buf.Len()); int64(len(p)) > room {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// responseCapture captures a response body for recording. A gzip or br body
+// is decoded on the way in, so the recording stays readable and the size
+// limit applies to the decoded body.
+type responseCapture struct {
+	captureBuffer
+	decoded bool
+
+	pw   *io.PipeWriter
+	done chan struct{}
+}
+
+func newResponseCapture(limit int64, encoding string) *responseCapture {
+	c := &responseCapture{captureBuffer: captureBuffer{limit: limit}}
+
+	var decode func(io.Reader) (io.Reader, error)
+	switch strings.ToLower(encoding) {
+	case "gzip":
+		decode = func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+	case "br":
+		decode = func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil }
+	default:
+		return c
+	}
+
+	pr, pw := io.Pipe()
+	c.decoded = true
+	c.pw = pw
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		decoded, err := decode(pr)
+		if err == nil {
+			_, err = io.CopyN(&c.captureBuffer, decoded, limit+1)
+		}
+		// An empty body has no compressed stream at all. Anything else that
+		// stops decoding early leaves only part of the body.
+		if err != nil && err != io.EOF {
+			c.truncated = true
+		}
+		// Unblock the writer once nothing more will be read.
+		pr.CloseWithError(errCaptureDone)
+	}()
+	return c
+}
+
+var errCaptureDone = errors.New("response capture finished")
+
+// Write never fails, so that recording cannot interrupt the response.
+func (c *responseCapture) Write(p []byte) (int, error) {
+	if c.pw == nil {
+		return c.captureBuffer.Write(p)
+	}
+	c.pw.Write(p)
+	return len(p), nil
+}
+
+// finish waits for the decoder to catch up. It may be called more than once.
+func (c *responseCapture) finish() {
+	if c.pw == nil {
+		return
+	}
+	c.pw.Close()
+	<-c.done
+	c.pw = nil
+}
+
+type teeReadCloser struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.w.Write(p[:n])
+	}
+	return n, err
+}
+
+// captureRequestBody tees the request body into a capture buffer when
+// recording is enabled.
+func (h *handler) captureRequestBody(r *http.Request) *captureBuffer {
+	if h.recorder == nil {
+		return nil
+	}
+
+	buffer := &captureBuffer{limit: h.recorder.maxBodyBytes}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &teeReadCloser{ReadCloser: r.Body, w: buffer}
+	}
+	return buffer
+}
+
+// captureResponseBody returns a capture for a response body sent with the
+// given Content-Encoding when recording is enabled. The caller must finish it.
+func (h *handler) captureResponseBody(encoding string) *responseCapture {
+	if h.recorder == nil {
+		return nil
+	}
+	return newResponseCapture(h.recorder.maxBodyBytes, encoding)
+}
+
+func (h *handler) record(r *http.Request, route *Route, start time.Time, requestBody *captureBuffer, statusCode int, header http.Header, responseBody *responseCapture) {
+	if h.recorder == nil {
+		return
+	}
+
+	exchange := &recording.Exchange{
+		Time:       start.UTC(),
+		DurationMS: float64(time.Since(start)) / float64(time.Millisecond),
+		Route:      route.Name,
+		RequestID:  requestID(r.Context()),
+		Request: recording.Request{
+			Method:    r.Method,
+			URL:       r.URL.String(),
+			TargetURL: route.TargetURL(r),
+			Header:    r.Header.Clone(),
+		},
+		Response: recording.Response{
+			StatusCode: statusCode,
+			Header:     header.Clone(),
+		},
+	}
+	if requestBody != nil {
+		exchange.Request.SetBody(requestBody.buf.Bytes(), requestBody.truncated)
+	}
+	if responseBody != nil {
+		responseBody.finish()
+		if responseBody.decoded {
+			exchange.Response.Header.Del("Content-Encoding")
+			exchange.Response.Header.Del("Content-Length")
+		}
+		exchange.Response.SetBody(responseBody.buf.Bytes(), responseBody.truncated)
+	}
+
+	if err := h.recorder.recorder.Record(exchange); err != nil {
+		h.logger.Warn("Failed to record exchange", map[string]interface{}{
+			"request_id": requestID(r.Context()),
+			"error":      err.Error(),
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"route":      route.Name,
+		})
+	}
+}
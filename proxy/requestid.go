@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	requestIDHeader = "X-Request-Id"
+
+	maxRequestIDLength = 128
+)
+
+type requestIDKey struct{}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID accepts IDs a client may reasonably send: short, and
+// printable ASCII without spaces or quotes so they are safe in every log
+// format.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID assigns the request its ID, honouring a valid incoming
+// X-Request-ID. The ID is stored in the context, set on the request so it is
+// forwarded upstream, and echoed in the response. Requests that already have
+// an ID are returned unchanged.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	if requestID(r.Context()) != "" {
+		return r
+	}
+
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+	r.Header.Set(requestIDHeader, id)
+	w.Header().Set(requestIDHeader, id)
+	return r
+}
+
+// writeError answers with the JSON error body used for every response the
+// proxy generates itself.
+func writeError(w http.ResponseWriter, r *http.Request, statusCode int, message string) {
+	body, _ := json.Marshal(struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request_id,omitempty"`
+		Timestamp string `json:"timestamp"`
+	}{
+		Error:     message,
+		RequestID: requestID(r.Context()),
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy/config"
+)
+
+const (
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 2 * time.Second
+	defaultRetryBudget    = 10 * time.Second
+	defaultMaxReplayBytes = 1 << 20
+)
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+// Status codes an upstream proxy answers with when it could not reach the
+// target or rejected our credentials.
+var proxyRetryStatus = map[int]bool{
+	http.StatusProxyAuthRequired:  true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+type retryPolicy struct {
+	maxAttempts    int
+	methods        map[string]bool
+	statusCodes    map[int]bool
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	budget         time.Duration
+	maxBodyBytes   int64
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newRetryPolicy(cfg *config.RetryConfig) *retryPolicy {
+	p := &retryPolicy{
+		maxAttempts:    cfg.MaxAttempts,
+		methods:        make(map[string]bool),
+		statusCodes:    make(map[int]bool),
+		initialBackoff: time.Duration(cfg.InitialBackoff),
+		maxBackoff:     time.Duration(cfg.MaxBackoff),
+		budget:         time.Duration(cfg.Budget),
+		maxBodyBytes:   cfg.MaxBodyBytes,
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	if p.maxAttempts == 0 {
+		p.maxAttempts = defaultMaxAttempts
+	}
+	for method := range idempotentMethods {
+		p.methods[method] = true
+	}
+	for _, method := range cfg.Methods {
+		p.methods[strings.ToUpper(method)] = true
+	}
+	for code := range proxyRetryStatus {
+		p.statusCodes[code] = true
+	}
+	for _, code := range cfg.StatusCodes {
+		p.statusCodes[code] = true
+	}
+	if p.initialBackoff == 0 {
+		p.initialBackoff = defaultInitialBackoff
+	}
+	if p.maxBackoff == 0 {
+		p.maxBackoff = defaultMaxBackoff
+	}
+	if p.budget == 0 {
+		p.budget = defaultRetryBudget
+	}
+	if p.maxBodyBytes == 0 {
+		p.maxBodyBytes = defaultMaxReplayBytes
+	}
+
+	return p
+}
+
+func (p *retryPolicy) retryableStatus(code int) bool {
+	return p.statusCodes[code]
+}
+
+// backoff returns the delay before the given retry (1 for the first retry),
+// using exponential growth with equal jitter.
+func (p *retryPolicy) backoff(retry int) time.Duration {
+	d := p.initialBackoff
+	for i := 1; i < retry && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	half := d / 2
+	return half + time.Duration(p.rand.Int63n(int64(half)+1))
+}
+
+// replayableBody makes the request body readable more than once by buffering
+// it in memory. Bodies larger than the limit are left streaming and the
+// request is not retried.
+type replayableBody struct {
+	data []byte
+}
+
+func (p *retryPolicy) prepareBody(req *http.Request) (*replayableBody, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if req.ContentLength > p.maxBodyBytes {
+		return nil, false, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, p.maxBodyBytes+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read request body: %w", err)
+	}
+
+	if int64(len(data)) > p.maxBodyBytes {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+		return nil, false, nil
+	}
+
+	return &replayableBody{data: data}, true, nil
+}
+
+func (b *replayableBody) reader() io.ReadCloser {
+	if b == nil {
+		return http.NoBody
+	}
+	return io.NopCloser(bytes.NewReader(b.data))
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
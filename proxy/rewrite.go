@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"proxy/config"
+)
+
+// defaultRewriteContentTypes are the bodies rewritten when body rewriting is
+// on and no content types are configured.
+var defaultRewriteContentTypes = []string{
+	"text/html",
+	"text/css",
+	"text/javascript",
+	"application/javascript",
+	"application/xhtml+xml",
+}
+
+// responseRewriter maps URLs pointing at a route's target back to the
+// proxy's public origin for one request.
+type responseRewriter struct {
+	route        *Route
+	targetHost   string
+	publicScheme string
+	publicHost   string
+	contentTypes []string
+	body         bool
+}
+
+// newResponseRewriter returns nil unless rewriting is enabled for route.
+func newResponseRewriter(route *Route, r *http.Request) *responseRewriter {
+	if !route.rewrite.Enabled {
+		return nil
+	}
+
+	rw := &responseRewriter{
+		route:        route,
+		targetHost:   strings.ToLower(route.Target.Host),
+		publicScheme: "http",
+		publicHost:   r.Host,
+		contentTypes: route.rewrite.ContentTypes,
+		body:         route.rewrite.Body,
+	}
+	if r.TLS != nil {
+		rw.publicScheme = "https"
+	}
+	if public, err := url.Parse(route.rewrite.PublicURL); err == nil && public.Host != "" {
+		rw.publicScheme = public.Scheme
+		rw.publicHost = public.Host
+	}
+	if len(rw.contentTypes) == 0 {
+		rw.contentTypes = defaultRewriteContentTypes
+	}
+	return rw
+}
+
+func (rw *responseRewriter) publicOrigin() string {
+	return rw.publicScheme + "://" + rw.publicHost
+}
+
+// rewriteHeaders rewrites Location, Content-Location, Refresh and the
+// Domain and Path of Set-Cookie.
+func (rw *responseRewriter) rewriteHeaders(header http.Header) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		if value := header.Get(name); value != "" {
+			header.Set(name, rw.rewriteURL(value))
+		}
+	}
+
+	if refresh := header.Get("Refresh"); refresh != "" {
+		header.Set("Refresh", rw.rewriteRefresh(refresh))
+	}
+
+	if cookies := header.Values("Set-Cookie"); len(cookies) > 0 {
+		rewritten := make([]string, len(cookies))
+		for i, cookie := range cookies {
+			rewritten[i] = rw.rewriteCookie(cookie)
+		}
+		header["Set-Cookie"] = rewritten
+	}
+}
+
+// rewriteURL maps an absolute URL on the target, or an absolute path on a
+// route that rewrites paths, to the proxy. Other URLs are left alone.
+func (rw *responseRewriter) rewriteURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+
+	switch {
+	case u.Host != "":
+		if !strings.EqualFold(u.Host, rw.targetHost) || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") {
+			return raw
+		}
+		if u.Scheme != "" {
+			u.Scheme = rw.publicScheme
+		}
+		u.Host = rw.publicHost
+	case u.Scheme == "" && strings.HasPrefix(u.Path, "/"):
+		if rw.route.publicPath(u.Path) == u.Path {
+			return raw
+		}
+	default:
+		return raw
+	}
+
+	if publicPath := rw.route.publicPath(u.Path); publicPath != u.Path {
+		u.Path = publicPath
+		u.RawPath = ""
+	}
+	return u.String()
+}
+
+// rewriteRefresh rewrites the URL in a Refresh header such as
+// "5; url=https://target.example/next".
+func (rw *responseRewriter) rewriteRefresh(refresh string) string {
+	i := strings.Index(strings.ToLower(refresh), "url=")
+	if i < 0 {
+		return refresh
+	}
+	target := strings.TrimSpace(refresh[i+len("url="):])
+	quote := ""
+	if len(target) >= 2 && (target[0] == '\'' || target[0] == '"') && target[len(target)-1] == target[0] {
+		quote = target[:1]
+		target = target[1 : len(target)-1]
+	}
+	return refresh[:i+len("url=")] + quote + rw.rewriteURL(target) + quote
+}
+
+// rewriteCookie points a cookie scoped to the target's domain at the proxy's
+// host instead, and maps its path through the route's path rewriting.
+func (rw *responseRewriter) rewriteCookie(cookie string) string {
+	targetHost := rw.targetHost
+	if host, _, err := net.SplitHostPort(targetHost); err == nil {
+		targetHost = host
+	}
+	publicHost := rw.publicHost
+	if host, _, err := net.SplitHostPort(publicHost); err == nil {
+		publicHost = host
+	}
+
+	parts := strings.Split(cookie, ";")
+	kept := parts[:1]
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			domain := strings.ToLower(strings.TrimPrefix(value, "."))
+			if domain != targetHost && !strings.HasSuffix(targetHost, "."+domain) {
+				break
+			}
+			// Browsers refuse a Domain that is an IP address, so such
+			// cookies become host-only cookies for the proxy.
+			if _, err := netip.ParseAddr(publicHost); err == nil {
+				continue
+			}
+			part = " " + name + "=" + publicHost
+		case "path":
+			if strings.HasPrefix(value, "/") {
+				part = " " + name + "=" + rw.route.publicPath(value)
+			}
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, ";")
+}
+
+// rewritesBody reports whether a response with header should have its body
+// rewritten: the content type is one of those configured and the encoding
+// is one we can decode.
+func (rw *responseRewriter) rewritesBody(r *http.Request, statusCode int, header http.Header) bool {
+	if !rw.body || r.Method == http.MethodHead || statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	matched := false
+	for _, contentType := range rw.contentTypes {
+		if strings.EqualFold(mediaType, contentType) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+
+	switch strings.ToLower(header.Get("Content-Encoding")) {
+	case "", "identity", "gzip", "br":
+		return true
+	}
+	return false
+}
+
+// publicPath is the inverse of TargetPath: the path on the proxy that leads
+// to path on the target. Paths outside the route's rewritten prefix are
+// returned unchanged.
+func (rt *Route) publicPath(path string) string {
+	if rt.pathPrefix == "" || (!rt.stripPrefix && rt.rewritePrefix == "") {
+		return path
+	}
+
+	prefix := strings.TrimSuffix(rt.rewritePrefix, "/")
+	if prefix != "" && !hasPathPrefix(path, prefix) {
+		return path
+	}
+	return strings.TrimSuffix(rt.pathPrefix, "/") + strings.TrimPrefix(path, prefix)
+}
+
+// limitAcceptEncoding keeps only the content codings body rewriting can
+// decode, so that the target does not pick one it cannot handle.
+func limitAcceptEncoding(header http.Header) {
+	values := header.Values("Accept-Encoding")
+	if len(values) == 0 {
+		return
+	}
+
+	var kept []string
+	for _, value := range values {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.TrimSpace(coding)
+			name, _, _ := strings.Cut(coding, ";")
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "gzip", "br", "identity":
+				kept = append(kept, coding)
+			}
+		}
+	}
+
+	if len(kept) == 0 {
+		header.Del("Accept-Encoding")
+		return
+	}
+	header.Set("Accept-Encoding", strings.Join(kept, ", "))
+}
+
+func inheritRewrite(route, defaults config.RewriteConfig) config.RewriteConfig {
+	if route.Enabled {
+		return route
+	}
+	return defaults
+}
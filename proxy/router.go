@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"proxy/config"
+)
+
+type Route struct {
+	Name          string
+	Target        config.TargetConfig
+	host          string
+	pathPrefix    string
+	stripPrefix   bool
+	rewritePrefix string
+	streaming     config.StreamingConfig
+	rewrite       config.RewriteConfig
+
+	requestHeaders  headerRules
+	responseHeaders headerRules
+}
+
+type Router struct {
+	routes   []*Route
+	fallback *Route
+}
+
+func NewRouter(cfg *config.Config) (*Router, error) {
+	routes := make([]*Route, 0, len(cfg.Routes))
+	for _, rc := range cfg.Routes {
+		route := &Route{
+			Name:          rc.Name,
+			Target:        rc.Target,
+			host:          strings.ToLower(rc.Host),
+			pathPrefix:    rc.PathPrefix,
+			stripPrefix:   rc.StripPrefix,
+			rewritePrefix: rc.RewritePrefix,
+			streaming:     inheritStreaming(rc.Streaming, cfg.Streaming),
+			rewrite:       inheritRewrite(rc.Rewrite, cfg.Rewrite),
+		}
+		if err := route.compileHeaderRules(&cfg.Headers, &rc.Headers); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rc.Name, err)
+		}
+		routes = append(routes, route)
+	}
+
+	// Host-bound routes win over host-agnostic ones, then the longest path
+	// prefix wins. Ties keep their configuration order.
+	sort.SliceStable(routes, func(i, j int) bool {
+		if (routes[i].host != "") != (routes[j].host != "") {
+			return routes[i].host != ""
+		}
+		return len(routes[i].pathPrefix) > len(routes[j].pathPrefix)
+	})
+
+	fallback := &Route{
+		Name:      config.DefaultRouteName,
+		Target:    cfg.Target,
+		streaming: cfg.Streaming,
+		rewrite:   cfg.Rewrite,
+	}
+	if err := fallback.compileHeaderRules(&cfg.Headers, &config.HeaderRulesConfig{}); err != nil {
+		return nil, err
+	}
+
+	return &Router{
+		routes:   routes,
+		fallback: fallback,
+	}, nil
+}
+
+// compileHeaderRules sets up the route's header rules: the top-level rules
+// followed by the route's own.
+func (rt *Route) compileHeaderRules(global, own *config.HeaderRulesConfig) error {
+	var err error
+	if rt.requestHeaders, err = compileHeaderRules(global.Request, own.Request); err != nil {
+		return err
+	}
+	rt.responseHeaders, err = compileHeaderRules(global.Response, own.Response)
+	return err
+}
+
+func inheritStreaming(route, defaults config.StreamingConfig) config.StreamingConfig {
+	if route.FlushInterval == 0 {
+		route.FlushInterval = defaults.FlushInterval
+	}
+	if route.WriteTimeout == 0 {
+		route.WriteTimeout = defaults.WriteTimeout
+	}
+	return route
+}
+
+func (rt *Router) Match(r *http.Request) *Route {
+	host := requestHost(r)
+	for _, route := range rt.routes {
+		if route.matches(host, r.URL.Path) {
+			return route
+		}
+	}
+	return rt.fallback
+}
+
+func (rt *Route) matches(host, path string) bool {
+	if rt.host != "" && !matchHost(rt.host, host) {
+		return false
+	}
+	if rt.pathPrefix != "" && !hasPathPrefix(path, rt.pathPrefix) {
+		return false
+	}
+	return true
+}
+
+func (rt *Route) TargetPath(path string) string {
+	if rt.pathPrefix == "" || (!rt.stripPrefix && rt.rewritePrefix == "") {
+		return path
+	}
+
+	rest := strings.TrimPrefix(path, strings.TrimSuffix(rt.pathPrefix, "/"))
+	prefix := strings.TrimSuffix(rt.rewritePrefix, "/")
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return prefix + rest
+}
+
+func (rt *Route) TargetURL(r *http.Request) string {
+	targetURL := rt.Target.Scheme + "://" + rt.Target.Host + rt.TargetPath(r.URL.Path)
+	if r.URL.RawQuery != "" {
+		targetURL += "?" + r.URL.RawQuery
+	}
+	return targetURL
+}
+
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func matchHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// hasPathPrefix matches on whole path segments so that "/api" matches
+// "/api" and "/api/x" but not "/apix".
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	if len(path) == len(prefix) || strings.HasSuffix(prefix, "/") {
+		return true
+	}
+	return path[len(prefix)] == '/'
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"proxy/socks"
+)
+
+const defaultSOCKSPort = "1080"
+
+// isSOCKSScheme reports whether an upstream URL scheme names a SOCKS5 proxy.
+// socks5h asks the proxy to resolve host names.
+func isSOCKSScheme(scheme string) bool {
+	return scheme == "socks5" || scheme == "socks5h"
+}
+
+func newSOCKSDialer(proxyURL *url.URL) *socks.Dialer {
+	addr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		addr = net.JoinHostPort(proxyURL.Hostname(), defaultSOCKSPort)
+	}
+	d := &socks.Dialer{
+		ProxyAddr: addr,
+		RemoteDNS: proxyURL.Scheme == "socks5h",
+	}
+	if proxyURL.User != nil {
+		d.Username = proxyURL.User.Username()
+		d.Password, _ = proxyURL.User.Password()
+	}
+	return d
+}
+
+type socksTransportKey struct {
+	base     *http.Transport
+	upstream *Upstream
+}
+
+// socksTransports holds copies of the client's transports that dial through
+// a SOCKS upstream instead of asking an HTTP proxy. Connection pools are
+// shared per transport, so every SOCKS upstream needs its own copy.
+type socksTransports struct {
+	mu         sync.Mutex
+	transports map[socksTransportKey]*http.Transport
+}
+
+func (s *socksTransports) get(base *http.Transport, upstream *Upstream) *http.Transport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := socksTransportKey{base: base, upstream: upstream}
+	if transport, ok := s.transports[key]; ok {
+		return transport
+	}
+
+	transport := base.Clone()
+	transport.Proxy = nil
+	transport.DialContext = upstream.socks.DialContext
+	// A custom dial function would otherwise turn HTTP/2 off.
+	transport.ForceAttemptHTTP2 = true
+	if s.transports == nil {
+		s.transports = make(map[socksTransportKey]*http.Transport)
+	}
+	s.transports[key] = transport
+	return transport
+}
+
+func (s *socksTransports) closeIdleConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, transport := range s.transports {
+		transport.CloseIdleConnections()
+	}
+}
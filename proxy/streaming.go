@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"proxy/config"
+)
+
+// defaultUpstreamTimeout bounds a proxied exchange that is not streaming
+// unless the proxy settings say otherwise.
+const defaultUpstreamTimeout = 30 * time.Second
+
+func upstreamTimeout(cfg *config.ProxyConfig) time.Duration {
+	if cfg.Timeout > 0 {
+		return time.Duration(cfg.Timeout)
+	}
+	return defaultUpstreamTimeout
+}
+
+var errUpstreamTimeout = errors.New("upstream request timed out")
+
+const (
+	defaultFlushInterval      = 100 * time.Millisecond
+	defaultStreamWriteTimeout = 30 * time.Second
+)
+
+// isStreaming reports whether resp should be relayed as it arrives rather
+// than in buffered chunks: server-sent events, and bodies of unknown length
+// such as chunked responses and long polls.
+func isStreaming(r *http.Request, resp *http.Response) bool {
+	if r.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && mediaType == "text/event-stream" {
+		return true
+	}
+	return resp.ContentLength < 0
+}
+
+// streamWriter relays a streamed response to the client. Events are flushed
+// as soon as they are written; other streams are flushed at most one flush
+// interval after a write. Each write pushes the connection's write deadline
+// out by the write timeout, so a stream lives as long as bytes keep flowing,
+// and calls progress so the caller can extend its upstream deadline too.
+type streamWriter struct {
+	dst          io.Writer
+	rc           *http.ResponseController
+	immediate    bool
+	interval     time.Duration
+	writeTimeout time.Duration
+	progress     func()
+
+	mu    sync.Mutex
+	timer *time.Timer
+	err   error
+}
+
+func newStreamWriter(w http.ResponseWriter, resp *http.Response, route *Route, progress func()) *streamWriter {
+	interval := time.Duration(route.streaming.FlushInterval)
+	if interval == 0 {
+		interval = defaultFlushInterval
+	}
+	writeTimeout := time.Duration(route.streaming.WriteTimeout)
+	if writeTimeout == 0 {
+		writeTimeout = defaultStreamWriteTimeout
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	sw := &streamWriter{
+		dst:          w,
+		rc:           http.NewResponseController(w),
+		immediate:    mediaType == "text/event-stream",
+		interval:     interval,
+		writeTimeout: writeTimeout,
+		progress:     progress,
+	}
+	sw.extendDeadline()
+	// Send the headers straight away so clients see the stream open.
+	sw.flushLocked()
+	return sw
+}
+
+func (s *streamWriter) extendDeadline() {
+	// Not every ResponseWriter supports deadlines; the server's own
+	// WriteTimeout then applies as before.
+	s.rc.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	n, err := s.dst.Write(p)
+	if err != nil {
+		s.err = err
+		return n, err
+	}
+	s.extendDeadline()
+	if s.progress != nil {
+		s.progress()
+	}
+
+	if s.immediate {
+		s.flushLocked()
+	} else if s.timer == nil {
+		s.timer = time.AfterFunc(s.interval, s.delayedFlush)
+	}
+	return n, nil
+}
+
+func (s *streamWriter) delayedFlush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timer = nil
+	s.flushLocked()
+}
+
+func (s *streamWriter) flushLocked() {
+	if s.err != nil {
+		return
+	}
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.err = err
+	}
+}
+
+// Close flushes anything still buffered and stops the flush timer.
+func (s *streamWriter) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.flushLocked()
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"proxy/config"
+	"proxy/tlsutil"
+)
+
+// PinError is returned from the TLS handshake when none of the keys in the
+// target's certificate chain matches a configured pin.
+type PinError struct {
+	Host      string
+	Presented []string
+}
+
+func (e *PinError) Error() string {
+	return fmt.Sprintf("certificate chain of %s matches no pinned key (presented %s)", e.Host, strings.Join(e.Presented, ", "))
+}
+
+// spkiPin formats the pin of cert the way pinned_keys expects it.
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// newTargetTLSConfig builds the TLS configuration for connections to
+// target, or returns nil when it has no settings of its own.
+func (c *Client) newTargetTLSConfig(target *config.TargetConfig) (*tls.Config, error) {
+	settings := &target.TLS
+	if settings.IsZero() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: settings.InsecureSkipVerify,
+	}
+
+	if settings.CAFile != "" {
+		pool, err := tlsutil.LoadCertPool(settings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if settings.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s: %w", settings.CertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(settings.PinnedKeys) > 0 {
+		pins := make([][]byte, 0, len(settings.PinnedKeys))
+		for _, pin := range settings.PinnedKeys {
+			hash, err := config.ParseSPKIPin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, hash)
+		}
+		// Runs after the chain is verified, and also when verification is
+		// skipped, in which case only the leaf's key is trusted.
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return c.checkPins(target.Host, pins, cs)
+		}
+	}
+
+	if settings.InsecureSkipVerify {
+		c.logger.Warn("INSECURE: TLS certificate verification is disabled for target, connections to it can be intercepted", map[string]interface{}{
+			"target": target.Host,
+		})
+	}
+
+	return tlsConfig, nil
+}
+
+// checkPins accepts the connection if one of pins matches a key in a
+// verified chain, or the leaf's key when verification was skipped, and
+// reports the mismatch otherwise. Other certificates the target merely sent
+// prove nothing, as anyone can include a public certificate in a chain.
+func (c *Client) checkPins(host string, pins [][]byte, cs tls.ConnectionState) error {
+	var candidates []*x509.Certificate
+	for _, verified := range cs.VerifiedChains {
+		candidates = append(candidates, verified...)
+	}
+	if len(cs.VerifiedChains) == 0 && len(cs.PeerCertificates) > 0 {
+		// The handshake proves possession of the leaf's key only.
+		candidates = append(candidates, cs.PeerCertificates[0])
+	}
+	for _, cert := range candidates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+
+	presented := make([]string, len(cs.PeerCertificates))
+	for i, cert := range cs.PeerCertificates {
+		presented[i] = spkiPin(cert)
+	}
+	if c.metrics != nil {
+		c.metrics.pinFailures.Inc(host)
+	}
+	c.logger.Error("Target certificate does not match pinned keys", map[string]interface{}{
+		"target":      host,
+		"server_name": cs.ServerName,
+		"presented":   presented,
+	})
+	return &PinError{Host: host, Presented: presented}
+}
+
+// targetTransport sends each request over the transport for its target's
+// host, so that targets with their own TLS settings get their own
+// connection pools.
+type targetTransport struct {
+	pool     *UpstreamPool
+	fallback *http.Transport
+	byHost   map[string]*http.Transport
+	socks    socksTransports
+}
+
+// newTargetTransport builds a transport for every target with TLS settings,
+// each a copy of base.
+func (c *Client) newTargetTransport(cfg *config.Config, base *http.Transport) (*targetTransport, error) {
+	t := &targetTransport{pool: c.pool, fallback: base, byHost: make(map[string]*http.Transport)}
+	c.targetTLS = make(map[string]*tls.Config)
+
+	targets := []*config.TargetConfig{&cfg.Target}
+	for i := range cfg.Routes {
+		targets = append(targets, &cfg.Routes[i].Target)
+	}
+	for _, target := range targets {
+		host := strings.ToLower(target.Host)
+		if _, ok := t.byHost[host]; ok {
+			continue
+		}
+		tlsConfig, err := c.newTargetTLSConfig(target)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", target.Host, err)
+		}
+		if tlsConfig == nil {
+			continue
+		}
+
+		transport := base.Clone()
+		transport.TLSClientConfig = tlsConfig
+		// Setting a TLS config would otherwise turn HTTP/2 off, which
+		// the default transport would have used.
+		transport.ForceAttemptHTTP2 = true
+		t.byHost[host] = transport
+		c.targetTLS[host] = tlsConfig
+	}
+	return t, nil
+}
+
+// RoundTrip also sends requests to SOCKS upstreams over their own copy of
+// the transport. Requests that were not given an upstream get one here.
+func (t *targetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	upstream, ok := req.Context().Value(upstreamContextKey{}).(*Upstream)
+	if !ok {
+		upstream = t.pool.Next(nil)
+		req = req.WithContext(context.WithValue(req.Context(), upstreamContextKey{}, upstream))
+	}
+
+	transport := t.fallback
+	if byHost, ok := t.byHost[strings.ToLower(req.URL.Host)]; ok {
+		transport = byHost
+	}
+	if upstream.socks != nil {
+		transport = t.socks.get(transport, upstream)
+	}
+	return transport.RoundTrip(req)
+}
+
+func (t *targetTransport) CloseIdleConnections() {
+	t.fallback.CloseIdleConnections()
+	for _, transport := range t.byHost {
+		transport.CloseIdleConnections()
+	}
+	t.socks.closeIdleConnections()
+}
+
+// tlsConfigFor returns a TLS configuration for a connection to host that
+// is dialled by hand, falling back to serverName for SNI.
+func (c *Client) tlsConfigFor(host, serverName string) *tls.Config {
+	tlsConfig := &tls.Config{}
+	if configured, ok := c.targetTLS[strings.ToLower(host)]; ok {
+		tlsConfig = configured.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverName
+	}
+	return tlsConfig
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+
+	"proxy/config"
+	"proxy/logging"
+	"proxy/tracing"
+)
+
+const defaultTracingServiceName = "proxy"
+
+func newTracer(cfg *config.TracingConfig, logger *logging.Logger) (*tracing.Tracer, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	var exporter tracing.Exporter
+	switch cfg.Exporter {
+	case config.TracingExporterStdout:
+		exporter = tracing.NewWriterExporter(os.Stdout)
+	case config.TracingExporterFile:
+		file, err := tracing.NewFileExporter(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		exporter = file
+	default:
+		exporter = tracing.NewOTLPExporter(cfg.Endpoint, cfg.Headers)
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+
+	// An unset ratio keeps every trace; an explicit 0 keeps none.
+	sampleRatio := 1.0
+	if cfg.SampleRatio != nil {
+		sampleRatio = *cfg.SampleRatio
+	}
+
+	return tracing.NewTracer(serviceName, sampleRatio, exporter, func(err error) {
+		logger.Warn("Failed to export spans", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}), nil
+}
+
+// startServerSpan starts the inbound span, continuing the caller's trace
+// when it sent a valid traceparent.
+func (h *handler) startServerSpan(r *http.Request) (*http.Request, *tracing.Span) {
+	if h.tracer == nil {
+		return r, nil
+	}
+
+	ctx := r.Context()
+	if remote, ok := tracing.Extract(r.Header); ok {
+		ctx = tracing.ContextWithRemote(ctx, remote)
+	}
+	ctx, span := h.tracer.Start(ctx, r.Method, tracing.KindServer)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("server.address", r.Host)
+	span.SetAttribute("client.address", clientIP(r))
+	span.SetAttribute("user_agent.original", r.UserAgent())
+	span.SetAttribute("proxy.request_id", requestID(ctx))
+	return r.WithContext(ctx), span
+}
+
+func finishServerSpan(span *tracing.Span, r *http.Request, statusCode int) {
+	if span == nil {
+		return
+	}
+	if route := accessInfoFrom(r.Context()).route; route != "" {
+		span.SetAttribute("proxy.route", route)
+	}
+	span.SetAttribute("http.response.status_code", statusCode)
+	if statusCode >= 500 {
+		span.SetStatus(tracing.StatusError, http.StatusText(statusCode))
+	}
+	span.Finish()
+}
+
+// startClientSpan starts the span for one upstream attempt and returns a
+// context that records the proxy dial, TLS handshake and first response
+// byte as span events.
+func (c *Client) startClientSpan(ctx context.Context, req *http.Request, upstream *Upstream, attempt int) (context.Context, *tracing.Span) {
+	ctx, span := c.tracer.Start(ctx, req.Method, tracing.KindClient)
+	if span == nil {
+		return ctx, nil
+	}
+
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("url.full", req.URL.String())
+	span.SetAttribute("server.address", req.URL.Host)
+	span.SetAttribute("proxy.upstream", upstream.String())
+	if attempt > 1 {
+		span.SetAttribute("http.request.resend_count", attempt-1)
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			span.AddEvent("connection.acquired", map[string]interface{}{"reused": info.Reused})
+		},
+		ConnectStart: func(network, addr string) {
+			span.AddEvent("proxy.dial.start", map[string]interface{}{"address": addr})
+		},
+		ConnectDone: func(network, addr string, err error) {
+			attributes := map[string]interface{}{"address": addr}
+			if err != nil {
+				attributes["error"] = err.Error()
+			}
+			span.AddEvent("proxy.dial.done", attributes)
+		},
+		TLSHandshakeStart: func() {
+			span.AddEvent("tls.handshake.start", nil)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			attributes := map[string]interface{}{}
+			if err != nil {
+				attributes["error"] = err.Error()
+			} else {
+				attributes["tls.version"] = tls.VersionName(state.Version)
+			}
+			span.AddEvent("tls.handshake.done", attributes)
+		},
+		GotFirstResponseByte: func() {
+			span.AddEvent("response.first_byte", nil)
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace), span
+}
+
+func finishClientSpan(span *tracing.Span, resp *http.Response, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.SetStatus(tracing.StatusError, err.Error())
+	} else {
+		span.SetAttribute("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= 400 {
+			span.SetStatus(tracing.StatusError, resp.Status)
+		}
+	}
+	span.Finish()
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+)
+
+// headerContainsToken reports whether any value of the named header lists
+// token, compared case-insensitively, as in "Connection: keep-alive, Upgrade".
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// announceTrailers declares the trailers resp announced so the client knows
+// to expect them, returning how many there were. Must be called before the
+// header is written.
+func announceTrailers(w http.ResponseWriter, resp *http.Response) int {
+	if len(resp.Trailer) == 0 {
+		return 0
+	}
+	names := make([]string, 0, len(resp.Trailer))
+	for name := range resp.Trailer {
+		names = append(names, name)
+	}
+	w.Header().Add("Trailer", strings.Join(names, ", "))
+	return len(names)
+}
+
+// copyTrailers sends the trailers that followed resp's body. Trailers the
+// target did not announce up front are sent with http.TrailerPrefix.
+func copyTrailers(w http.ResponseWriter, resp *http.Response, announced int) {
+	if len(resp.Trailer) == 0 {
+		return
+	}
+	prefix := ""
+	if len(resp.Trailer) != announced {
+		prefix = http.TrailerPrefix
+	}
+	for name, values := range resp.Trailer {
+		w.Header()[prefix+name] = values
+	}
+}
+
+// withInformational returns a context whose client trace relays 1xx
+// responses from the target, such as 103 Early Hints, to the client before
+// the final response. 100 Continue is left to net/http, which sends it when
+// the transport starts reading the request body.
+func withInformational(ctx context.Context, r *http.Request, w http.ResponseWriter) context.Context {
+	if !r.ProtoAtLeast(1, 1) {
+		return ctx
+	}
+
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusContinue {
+				return nil
+			}
+
+			// WriteHeader sends whatever is in the header map with a 1xx
+			// response but does not reset it, so restore the final
+			// response's headers afterwards.
+			h := w.Header()
+			saved := h.Clone()
+			for name, values := range header {
+				h[name] = values
+			}
+			w.WriteHeader(code)
+			for name := range h {
+				delete(h, name)
+			}
+			for name, values := range saved {
+				h[name] = values
+			}
+			return nil
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace)
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	tunnelDialTimeout        = 10 * time.Second
+	defaultTunnelIdleTimeout = 5 * time.Minute
+)
+
+// DialTunnel opens a connection to addr through the upstream proxy pool by
+// issuing a CONNECT request, failing over to the next upstream when one
+// cannot be reached.
+func (c *Client) DialTunnel(ctx context.Context, addr string) (net.Conn, *Upstream, error) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if err := c.waitForHost(ctx, host); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tried := make(map[*Upstream]bool)
+	var lastErr error
+	for attempt := 1; attempt <= c.pool.Len(); attempt++ {
+		upstream := c.pool.Next(tried)
+		if upstream == nil {
+			break
+		}
+		tried[upstream] = true
+
+		c.logger.Debug("Opening tunnel", map[string]interface{}{
+			"request_id": requestID(ctx),
+			"attempt":    attempt,
+			"address":    addr,
+			"upstream":   upstream.String(),
+		})
+
+		conn, err := dialUpstream(ctx, upstream, addr)
+		if err == nil {
+			c.pool.MarkSuccess(upstream)
+			return conn, upstream, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, fmt.Errorf("tunnel to %s failed: %w", addr, err)
+		}
+
+		c.recordUpstreamFailure(ctx, upstream, err)
+		lastErr = err
+	}
+
+	return nil, nil, fmt.Errorf("tunnel to %s failed: %w", addr, lastErr)
+}
+
+// dialUpstream connects to addr through upstream, with a SOCKS5 CONNECT or
+// an HTTP CONNECT depending on the kind of proxy it is.
+func dialUpstream(ctx context.Context, upstream *Upstream, addr string) (net.Conn, error) {
+	if upstream.socks == nil {
+		return dialConnect(ctx, upstream.URL(), addr)
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, tunnelDialTimeout)
+	defer cancel()
+	conn, err := upstream.socks.DialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("upstream SOCKS proxy failed: %w", err)
+	}
+	return conn, nil
+}
+
+func dialConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, tunnelDialTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(dialCtx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial upstream proxy: %w", err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http":
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(dialCtx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with upstream proxy failed: %w", err)
+		}
+		conn = tlsConn
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("unsupported upstream proxy scheme: %q", proxyURL.Scheme)
+	}
+
+	if deadline, ok := dialCtx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := proxyURL.User.Username() + ":" + password
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to upstream proxy: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from upstream proxy: %w", err)
+	}
+
+	// A successful CONNECT response has no body; everything after the
+	// headers belongs to the tunnel.
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused CONNECT: %s", resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn keeps bytes the upstream sent right after its CONNECT
+// response, which would otherwise be lost in the bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection if it supports that and
+// closes it completely otherwise, as splice would for a plain connection.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// idleConn pushes the read and write deadlines forward on every successful
+// read or write so that only idle connections time out.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// splice copies bytes in both directions until either side is done and
+// returns the number of bytes sent from client to upstream and back.
+func splice(client, upstream net.Conn, idleTimeout time.Duration) (sent, received int64) {
+	client = &idleConn{Conn: client, timeout: idleTimeout}
+	upstream = &idleConn{Conn: upstream, timeout: idleTimeout}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	copyHalf := func(dst, src net.Conn, n *int64) {
+		defer wg.Done()
+		*n, _ = io.Copy(dst, src)
+		if cw, ok := dst.(*idleConn).Conn.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	go copyHalf(upstream, client, &sent)
+	go copyHalf(client, upstream, &received)
+	wg.Wait()
+
+	client.Close()
+	upstream.Close()
+	return sent, received
+}
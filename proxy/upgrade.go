@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isUpgradeRequest reports whether r asks to switch protocols, as a
+// WebSocket handshake does.
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && headerContainsToken(r.Header, "Connection", "upgrade")
+}
+
+// serveUpgrade proxies a protocol upgrade. The target is reached through a
+// CONNECT tunnel opened via the upstream proxy pool, the handshake is sent
+// over it, and on 101 Switching Protocols the client connection is hijacked
+// and spliced to the tunnel until either side closes or goes idle.
+func (h *handler) serveUpgrade(w http.ResponseWriter, r *http.Request, route *Route, start time.Time) {
+	protocol := r.Header.Get("Upgrade")
+
+	h.logger.Info("Upgrade requested", map[string]interface{}{
+		"request_id": requestID(r.Context()),
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"route":      route.Name,
+		"protocol":   protocol,
+		"remote_ip":  r.RemoteAddr,
+	})
+
+	ctx, cancel := context.WithTimeout(r.Context(), upstreamTimeout(&h.config.Proxy))
+	defer cancel()
+
+	conn, br, resp, err := h.client.upgrade(ctx, r, route)
+	if err != nil {
+		var limitErr *RateLimitError
+		if errors.As(err, &limitErr) {
+			h.rejectRateLimited(w, r, "upstream", limitErr.Host, route.Name, limitErr.RetryAfter)
+			return
+		}
+
+		statusCode := http.StatusBadGateway
+		if ctx.Err() == context.DeadlineExceeded {
+			statusCode = http.StatusGatewayTimeout
+			h.metrics.timeouts.Inc(route.Name)
+		}
+		h.metrics.requests.Inc(r.Method, strconv.Itoa(statusCode), route.Name)
+
+		h.logger.Error("Failed to forward upgrade", map[string]interface{}{
+			"request_id":  requestID(r.Context()),
+			"error":       err.Error(),
+			"path":        r.URL.Path,
+			"route":       route.Name,
+			"elapsed":     time.Since(start),
+			"status_code": statusCode,
+		})
+		writeError(w, r, statusCode, "Proxy error")
+		return
+	}
+	defer conn.Close()
+
+	// The target declined to switch; relay its answer like any response.
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		copyResponseHeaders(w, resp)
+		if rewriter := newResponseRewriter(route, r); rewriter != nil {
+			rewriter.rewriteHeaders(w.Header())
+		}
+		route.responseHeaders.apply(w.Header(), r, route)
+		w.WriteHeader(resp.StatusCode)
+		written, _ := io.Copy(w, resp.Body)
+		h.metrics.responseBytes.Add(float64(written), route.Name)
+		h.metrics.requests.Inc(r.Method, strconv.Itoa(resp.StatusCode), route.Name)
+
+		h.logger.Warn("Upgrade refused by target", map[string]interface{}{
+			"request_id":  requestID(r.Context()),
+			"path":        r.URL.Path,
+			"route":       route.Name,
+			"status_code": resp.StatusCode,
+			"elapsed":     time.Since(start),
+		})
+		return
+	}
+
+	clientConn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		h.logger.Error("Failed to hijack connection", map[string]interface{}{
+			"request_id": requestID(r.Context()),
+			"error":      err.Error(),
+			"path":       r.URL.Path,
+		})
+		writeError(w, r, http.StatusInternalServerError, "Upgrade not supported")
+		return
+	}
+	defer clientConn.Close()
+
+	// The server's read and write timeouts must not apply to the tunnel.
+	clientConn.SetDeadline(time.Time{})
+
+	route.responseHeaders.apply(resp.Header, r, route)
+	resp.Header.Set(requestIDHeader, requestID(r.Context()))
+	fmt.Fprintf(rw, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(rw)
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	var client net.Conn = clientConn
+	if rw.Reader.Buffered() > 0 {
+		client = &bufferedConn{Conn: clientConn, r: rw.Reader}
+	}
+	var upstream net.Conn = conn
+	if br.Buffered() > 0 {
+		upstream = &bufferedConn{Conn: conn, r: br}
+	}
+
+	info := accessInfoFrom(r.Context())
+	info.status = http.StatusSwitchingProtocols
+	h.metrics.requests.Inc(r.Method, strconv.Itoa(http.StatusSwitchingProtocols), route.Name)
+	h.metrics.openTunnels.Inc(upgradeTunnelKind)
+	defer h.metrics.openTunnels.Dec(upgradeTunnelKind)
+
+	idleTimeout := time.Duration(h.config.Upgrade.IdleTimeout)
+	if idleTimeout == 0 {
+		idleTimeout = defaultTunnelIdleTimeout
+	}
+
+	sent, received := splice(client, upstream, idleTimeout)
+	info.bytes = received
+	h.metrics.requestBytes.Add(float64(sent), route.Name)
+	h.metrics.responseBytes.Add(float64(received), route.Name)
+
+	h.logger.Info("Upgraded connection closed", map[string]interface{}{
+		"request_id":     requestID(r.Context()),
+		"path":           r.URL.Path,
+		"route":          route.Name,
+		"protocol":       protocol,
+		"bytes_sent":     sent,
+		"bytes_received": received,
+		"elapsed":        time.Since(start),
+	})
+}
+
+// upgrade opens a tunnel to the route's target and sends the handshake,
+// returning the connection, the reader holding any bytes the target sent
+// after its response, and the response itself.
+func (c *Client) upgrade(ctx context.Context, originalReq *http.Request, route *Route) (net.Conn, *bufio.Reader, *http.Response, error) {
+	host := route.Target.Host
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "80"
+		if route.Target.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+
+	conn, _, err := c.DialTunnel(ctx, addr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if route.Target.Scheme == "https" {
+		serverName, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			serverName = addr
+		}
+		tlsConfig := c.tlsConfigFor(host, serverName)
+		tlsConfig.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, nil, fmt.Errorf("TLS handshake with target failed: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	req, err := http.NewRequestWithContext(ctx, originalReq.Method, route.TargetURL(originalReq), nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	copyHeaders(req, originalReq)
+	c.forwarded.apply(req, originalReq)
+	c.clientCert.apply(req, originalReq)
+	route.requestHeaders.apply(req.Header, originalReq, route)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", originalReq.Header.Get("Upgrade"))
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to send upgrade request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to read upgrade response: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if resp.StatusCode == http.StatusSwitchingProtocols && !strings.EqualFold(resp.Header.Get("Upgrade"), req.Header.Get("Upgrade")) {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("target switched to unexpected protocol %q", resp.Header.Get("Upgrade"))
+	}
+
+	return conn, br, resp, nil
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"proxy/config"
+	"proxy/socks"
+)
+
+const (
+	defaultMaxFailures     = 3
+	defaultFailureCooldown = 30 * time.Second
+)
+
+type Upstream struct {
+	url    *url.URL
+	weight int
+	socks  *socks.Dialer
+
+	mu             sync.Mutex
+	failures       int
+	unhealthyUntil time.Time
+}
+
+func (u *Upstream) URL() *url.URL {
+	return u.url
+}
+
+// String returns the upstream address without credentials so it is safe to
+// log.
+func (u *Upstream) String() string {
+	return u.url.Redacted()
+}
+
+func (u *Upstream) healthy(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.unhealthyUntil)
+}
+
+type UpstreamPool struct {
+	upstreams   []*Upstream
+	strategy    string
+	maxFailures int
+	cooldown    time.Duration
+
+	mu   sync.Mutex
+	next int
+	rand *rand.Rand
+}
+
+func NewUpstreamPool(cfg *config.ProxyConfig) (*UpstreamPool, error) {
+	list := cfg.UpstreamList()
+	if len(list) == 0 {
+		return nil, fmt.Errorf("proxy URL is required")
+	}
+
+	upstreams := make([]*Upstream, 0, len(list))
+	for _, uc := range list {
+		proxyURL, err := url.Parse(uc.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		if uc.Username != "" || uc.Password != "" {
+			proxyURL.User = url.UserPassword(uc.Username, uc.Password)
+		}
+
+		weight := uc.Weight
+		if weight == 0 {
+			weight = 1
+		}
+
+		upstream := &Upstream{
+			url:    proxyURL,
+			weight: weight,
+		}
+		if isSOCKSScheme(proxyURL.Scheme) {
+			upstream.socks = newSOCKSDialer(proxyURL)
+		}
+		upstreams = append(upstreams, upstream)
+	}
+
+	strategy := cfg.Strategy
+	if strategy == "" {
+		strategy = config.StrategyRoundRobin
+	}
+
+	maxFailures := cfg.MaxFailures
+	if maxFailures == 0 {
+		maxFailures = defaultMaxFailures
+	}
+
+	cooldown := time.Duration(cfg.FailureCooldown)
+	if cooldown == 0 {
+		cooldown = defaultFailureCooldown
+	}
+
+	return &UpstreamPool{
+		upstreams:   upstreams,
+		strategy:    strategy,
+		maxFailures: maxFailures,
+		cooldown:    cooldown,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+func (p *UpstreamPool) Len() int {
+	return len(p.upstreams)
+}
+
+// Next picks an upstream according to the configured strategy, skipping any
+// in the exclude set and any that are cooling down after repeated failures.
+// When every candidate is unhealthy it still returns one so that requests
+// keep probing rather than failing outright.
+func (p *UpstreamPool) Next(exclude map[*Upstream]bool) *Upstream {
+	now := time.Now()
+
+	candidates := make([]*Upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if !exclude[u] && u.healthy(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, u := range p.upstreams {
+			if !exclude[u] {
+				candidates = append(candidates, u)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch p.strategy {
+	case config.StrategyRandom:
+		return candidates[p.rand.Intn(len(candidates))]
+	case config.StrategyWeighted:
+		total := 0
+		for _, u := range candidates {
+			total += u.weight
+		}
+		n := p.rand.Intn(total)
+		for _, u := range candidates {
+			if n < u.weight {
+				return u
+			}
+			n -= u.weight
+		}
+		return candidates[len(candidates)-1]
+	default:
+		u := candidates[p.next%len(candidates)]
+		p.next++
+		return u
+	}
+}
+
+func (p *UpstreamPool) MarkSuccess(u *Upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures = 0
+	u.unhealthyUntil = time.Time{}
+}
+
+// MarkFailure records a failed attempt and reports whether the upstream has
+// just been taken out of rotation.
+func (p *UpstreamPool) MarkFailure(u *Upstream) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures++
+	if u.failures >= p.maxFailures {
+		u.failures = 0
+		u.unhealthyUntil = time.Now().Add(p.cooldown)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled at rate tokens per second up to burst.
+type Bucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Reserve takes a token if one is available now or will be within maxWait,
+// returning how long the caller must wait before proceeding. When the wait
+// would exceed maxWait nothing is taken and the returned duration is how long
+// until a token is available.
+func (b *Bucket) Reserve(now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		return wait, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// Refund returns a token taken by Reserve that went unused.
+func (b *Bucket) Refund() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+func (b *Bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// Limiter keeps one bucket per key, such as a client or a target host.
+type Limiter struct {
+	rate  float64
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+	calls   int
+}
+
+const sweepInterval = 1024
+
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*Bucket),
+	}
+}
+
+func (l *Limiter) bucket(key string, now time.Time) *Bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Full buckets carry no state worth keeping, so they are dropped
+	// periodically to bound memory when keys churn.
+	l.calls++
+	if l.calls%sweepInterval == 0 {
+		for k, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+func (l *Limiter) Reserve(key string, maxWait time.Duration) (time.Duration, bool) {
+	now := time.Now()
+	return l.bucket(key, now).Reserve(now, maxWait)
+}
+
+// Wait blocks until a token for key is available, for at most maxWait. It
+// returns false along with the suggested retry delay when the limit is
+// exceeded, and the context error if ctx ends while queued. Only a request
+// that goes ahead keeps its token.
+func (l *Limiter) Wait(ctx context.Context, key string, maxWait time.Duration) (time.Duration, bool, error) {
+	now := time.Now()
+	b := l.bucket(key, now)
+	wait, ok := b.Reserve(now, maxWait)
+	if !ok {
+		return wait, false, nil
+	}
+	if wait == 0 {
+		return 0, true, nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return 0, true, nil
+	case <-ctx.Done():
+		b.Refund()
+		return 0, false, ctx.Err()
+	}
+}
@@ -0,0 +1,121 @@
+package recording
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const bodyEncodingBase64 = "base64"
+
+// Exchange is one proxied request and the response it received, stored as a
+// single line of the recording file.
+type Exchange struct {
+	Time       time.Time `json:"time"`
+	DurationMS float64   `json:"duration_ms"`
+	Route      string    `json:"route,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Request    Request   `json:"request"`
+	Response   Response  `json:"response"`
+}
+
+type Request struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	TargetURL     string      `json:"target_url,omitempty"`
+	Header        http.Header `json:"header,omitempty"`
+	Body          string      `json:"body,omitempty"`
+	BodyEncoding  string      `json:"body_encoding,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+type Response struct {
+	StatusCode    int         `json:"status_code"`
+	Header        http.Header `json:"header,omitempty"`
+	Body          string      `json:"body,omitempty"`
+	BodyEncoding  string      `json:"body_encoding,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+// encodeBody keeps text bodies readable in the file and falls back to
+// base64 for anything that is not valid UTF-8.
+func encodeBody(data []byte) (string, string) {
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return base64.StdEncoding.EncodeToString(data), bodyEncodingBase64
+}
+
+func decodeBody(body, encoding string) ([]byte, error) {
+	if encoding == bodyEncodingBase64 {
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return []byte(body), nil
+}
+
+func (r *Request) SetBody(data []byte, truncated bool) {
+	r.Body, r.BodyEncoding = encodeBody(data)
+	r.BodyTruncated = truncated
+}
+
+func (r *Response) SetBody(data []byte, truncated bool) {
+	r.Body, r.BodyEncoding = encodeBody(data)
+	r.BodyTruncated = truncated
+}
+
+func (r *Response) BodyBytes() ([]byte, error) {
+	return decodeBody(r.Body, r.BodyEncoding)
+}
+
+// Recorder appends redacted exchanges to a JSONL file. It is safe for
+// concurrent use; each exchange is written with a single append.
+type Recorder struct {
+	redactor *Redactor
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func Open(path string, redactor *Redactor) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording file: %w", err)
+	}
+	return &Recorder{redactor: redactor, file: file}, nil
+}
+
+func (r *Recorder) Record(exchange *Exchange) error {
+	if r.redactor != nil {
+		r.redactor.Redact(exchange)
+	}
+
+	line, err := json.Marshal(exchange)
+	if err != nil {
+		return fmt.Errorf("failed to encode exchange: %w", err)
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return os.ErrClosed
+	}
+	_, err = r.file.Write(line)
+	return err
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
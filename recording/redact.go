@@ -0,0 +1,106 @@
+package recording
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+const redacted = "[REDACTED]"
+
+// defaultRedactHeaders are always redacted since they carry credentials.
+var defaultRedactHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// Redactor masks secrets before an exchange is written: the values of
+// sensitive headers and query parameters, and any match of the patterns in
+// URLs and text bodies.
+type Redactor struct {
+	headers  map[string]bool
+	query    map[string]bool
+	patterns []*regexp.Regexp
+}
+
+func NewRedactor(headers, query, patterns []string) (*Redactor, error) {
+	r := &Redactor{
+		headers: make(map[string]bool),
+		query:   make(map[string]bool),
+	}
+
+	for _, name := range append(defaultRedactHeaders, headers...) {
+		r.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range query {
+		r.query[name] = true
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+
+	return r, nil
+}
+
+func (r *Redactor) Redact(exchange *Exchange) {
+	exchange.Request.URL = r.redactURL(exchange.Request.URL)
+	exchange.Request.TargetURL = r.redactURL(exchange.Request.TargetURL)
+	r.redactHeader(exchange.Request.Header)
+	r.redactHeader(exchange.Response.Header)
+	if exchange.Request.BodyEncoding == "" {
+		exchange.Request.Body = r.redactText(exchange.Request.Body)
+	}
+	if exchange.Response.BodyEncoding == "" {
+		exchange.Response.Body = r.redactText(exchange.Response.Body)
+	}
+}
+
+func (r *Redactor) redactHeader(header http.Header) {
+	for name, values := range header {
+		if !r.headers[name] {
+			continue
+		}
+		for i := range values {
+			values[i] = redacted
+		}
+	}
+}
+
+func (r *Redactor) redactURL(raw string) string {
+	if raw == "" {
+		return raw
+	}
+
+	if len(r.query) > 0 {
+		if u, err := url.Parse(raw); err == nil && u.RawQuery != "" {
+			values := u.Query()
+			changed := false
+			for name := range values {
+				if r.query[name] {
+					values[name] = []string{redacted}
+					changed = true
+				}
+			}
+			if changed {
+				u.RawQuery = values.Encode()
+				raw = u.String()
+			}
+		}
+	}
+
+	return r.redactText(raw)
+}
+
+func (r *Redactor) redactText(s string) string {
+	for _, re := range r.patterns {
+		s = re.ReplaceAllString(s, redacted)
+	}
+	return s
+}
@@ -0,0 +1,145 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Load reads every exchange from a recording file. Lines that are not
+// recorded exchanges are skipped so a file can be shared with other notes.
+func Load(path string) ([]*Exchange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording file: %w", err)
+	}
+	defer file.Close()
+
+	var exchanges []*Exchange
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var exchange Exchange
+		if err := json.Unmarshal(line, &exchange); err != nil {
+			return nil, fmt.Errorf("recording line %d: %w", lineNo, err)
+		}
+		if exchange.Request.Method == "" || exchange.Response.StatusCode == 0 {
+			continue
+		}
+		exchanges = append(exchanges, &exchange)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recording file: %w", err)
+	}
+
+	return exchanges, nil
+}
+
+// Replayer serves recorded responses as a mock of the target. Requests are
+// matched on method and URL, falling back to method and path so redacted or
+// changing query parameters still find a response. When an endpoint was
+// recorded several times the responses are served in order, repeating the
+// last one.
+type Replayer struct {
+	byURL  map[string][]*Exchange
+	byPath map[string][]*Exchange
+
+	mu   sync.Mutex
+	next map[string]int
+}
+
+func NewReplayer(exchanges []*Exchange) *Replayer {
+	p := &Replayer{
+		byURL:  make(map[string][]*Exchange),
+		byPath: make(map[string][]*Exchange),
+		next:   make(map[string]int),
+	}
+
+	for _, exchange := range exchanges {
+		u, err := url.Parse(exchange.Request.URL)
+		if err != nil {
+			continue
+		}
+		urlKey := exchange.Request.Method + " " + u.RequestURI()
+		pathKey := exchange.Request.Method + " " + u.Path
+		p.byURL[urlKey] = append(p.byURL[urlKey], exchange)
+		p.byPath[pathKey] = append(p.byPath[pathKey], exchange)
+	}
+
+	return p
+}
+
+func (p *Replayer) Len() int {
+	n := 0
+	for _, exchanges := range p.byURL {
+		n += len(exchanges)
+	}
+	return n
+}
+
+// Match returns the recorded exchange to answer r with, if any.
+func (p *Replayer) Match(r *http.Request) (*Exchange, bool) {
+	urlKey := r.Method + " " + r.URL.RequestURI()
+	pathKey := r.Method + " " + r.URL.Path
+
+	key, candidates := "url:"+urlKey, p.byURL[urlKey]
+	if len(candidates) == 0 {
+		key, candidates = "path:"+pathKey, p.byPath[pathKey]
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := p.next[key]
+	if i < len(candidates)-1 {
+		p.next[key] = i + 1
+	}
+	return candidates[i], true
+}
+
+func (p *Replayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	exchange, ok := p.Match(r)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf(`{"error":"No recorded response","timestamp":"%s"}`, time.Now().Format(time.RFC3339))))
+		return
+	}
+
+	body, err := exchange.Response.BodyBytes()
+	// A compressed body that was cut off cannot be decompressed by clients.
+	cutOff := exchange.Response.BodyTruncated && exchange.Response.Header.Get("Content-Encoding") != ""
+	if err != nil || cutOff {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"error":"Corrupt recorded body","timestamp":"%s"}`, time.Now().Format(time.RFC3339))))
+		return
+	}
+
+	for name, values := range exchange.Response.Header {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	// The recorded body may have been truncated, so the original length and
+	// transfer coding no longer apply.
+	w.Header().Del("Transfer-Encoding")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(exchange.Response.StatusCode)
+	w.Write(body)
+}
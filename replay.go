@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"proxy/config"
+	"proxy/logging"
+	"proxy/recording"
+)
+
+// runReplay serves responses from a recording file instead of proxying, so
+// clients can be developed against the target offline.
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := flags.String("file", "recordings.jsonl", "Path to the recording file")
+	host := flags.String("host", "127.0.0.1", "Address to listen on")
+	port := flags.Int("port", 8080, "Port to listen on")
+	level := flags.String("log-level", "info", "Logging level")
+	flags.Parse(args)
+
+	logger := logging.NewLogger(&config.LoggingConfig{Level: *level, Format: "json"})
+
+	exchanges, err := recording.Load(*file)
+	if err != nil {
+		logger.Error("Failed to load recording", map[string]interface{}{
+			"file":  *file,
+			"error": err.Error(),
+		})
+		os.Exit(1)
+	}
+	replayer := recording.NewReplayer(exchanges)
+
+	server := &http.Server{
+		Addr: fmt.Sprintf("%s:%d", *host, *port),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			replayer.ServeHTTP(sw, r)
+			logger.Info("Replayed request", map[string]interface{}{
+				"method":      r.Method,
+				"path":        r.URL.Path,
+				"query":       r.URL.RawQuery,
+				"status_code": sw.status,
+			})
+		}),
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	go func() {
+		logger.Info("Replay server starting", map[string]interface{}{
+			"address":   server.Addr,
+			"file":      *file,
+			"exchanges": replayer.Len(),
+		})
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("Replay server failed to start", map[string]interface{}{
+				"error": err.Error(),
+			})
+			os.Exit(1)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
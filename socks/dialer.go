@@ -0,0 +1,253 @@
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+const (
+	version5 = 0x05
+
+	methodNoAuth       = 0x00
+	methodUserPassword = 0x02
+	methodNoAcceptable = 0xff
+
+	userPasswordVersion = 0x01
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+var (
+	ErrNoAcceptableMethod = errors.New("socks: proxy accepts none of our authentication methods")
+	ErrAuthFailed         = errors.New("socks: proxy rejected username or password")
+)
+
+// ReplyError is a failure reported by the proxy in its reply to a CONNECT
+// request (RFC 1928, section 6).
+type ReplyError byte
+
+func (e ReplyError) Error() string {
+	switch e {
+	case 0x01:
+		return "socks: general SOCKS server failure"
+	case 0x02:
+		return "socks: connection not allowed by ruleset"
+	case 0x03:
+		return "socks: network unreachable"
+	case 0x04:
+		return "socks: host unreachable"
+	case 0x05:
+		return "socks: connection refused"
+	case 0x06:
+		return "socks: TTL expired"
+	case 0x07:
+		return "socks: command not supported"
+	case 0x08:
+		return "socks: address type not supported"
+	}
+	return fmt.Sprintf("socks: unknown reply code %#x", byte(e))
+}
+
+// Dialer opens TCP connections through a SOCKS5 proxy (RFC 1928), logging
+// in with a username and password (RFC 1929) when one is set.
+type Dialer struct {
+	ProxyAddr string
+	Username  string
+	Password  string
+	// RemoteDNS sends host names for the proxy to resolve rather than
+	// resolving them locally, as socks5h:// URLs ask for.
+	RemoteDNS bool
+}
+
+// DialContext connects to addr through the proxy. The handshake is bound by
+// ctx; the returned connection is not.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks: unsupported network %q", network)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("socks: invalid address %q: %w", addr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks: invalid port in %q", addr)
+	}
+
+	dest, err := d.destination(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dest = binary.BigEndian.AppendUint16(dest, uint16(port))
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("socks: failed to dial proxy: %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Unblock the handshake if ctx is cancelled halfway through.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	err = d.handshake(conn, dest)
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// destination encodes host as a SOCKS address: an IP address as it is, and
+// a name either as it is or resolved here, depending on RemoteDNS.
+func (d *Dialer) destination(ctx context.Context, host string) ([]byte, error) {
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		if d.RemoteDNS {
+			if len(host) > 255 {
+				return nil, fmt.Errorf("socks: host name too long: %s", host)
+			}
+			return append([]byte{atypDomain, byte(len(host))}, host...), nil
+		}
+
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, fmt.Errorf("socks: failed to resolve %s: %w", host, err)
+		}
+		ip = ips[0]
+		for _, candidate := range ips {
+			if candidate.Unmap().Is4() {
+				ip = candidate
+				break
+			}
+		}
+	}
+
+	ip = ip.Unmap()
+	if ip.Is4() {
+		b := ip.As4()
+		return append([]byte{atypIPv4}, b[:]...), nil
+	}
+	b := ip.As16()
+	return append([]byte{atypIPv6}, b[:]...), nil
+}
+
+func (d *Dialer) handshake(conn net.Conn, dest []byte) error {
+	methods := []byte{methodNoAuth}
+	if d.Username != "" || d.Password != "" {
+		methods = append(methods, methodUserPassword)
+	}
+	greeting := append([]byte{version5, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("socks: failed to send greeting: %w", err)
+	}
+
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return fmt.Errorf("socks: failed to read method selection: %w", err)
+	}
+	if choice[0] != version5 {
+		return fmt.Errorf("socks: unexpected protocol version %d", choice[0])
+	}
+	switch choice[1] {
+	case methodNoAuth:
+	case methodUserPassword:
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	case methodNoAcceptable:
+		return ErrNoAcceptableMethod
+	default:
+		return fmt.Errorf("socks: proxy chose unoffered method %#x", choice[1])
+	}
+
+	request := append([]byte{version5, cmdConnect, 0x00}, dest...)
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("socks: failed to send CONNECT: %w", err)
+	}
+	return readReply(conn)
+}
+
+// authenticate runs the username/password subnegotiation of RFC 1929.
+func (d *Dialer) authenticate(conn net.Conn) error {
+	if len(d.Username) == 0 || len(d.Username) > 255 || len(d.Password) > 255 {
+		return fmt.Errorf("socks: username must be 1 to 255 bytes and password at most 255")
+	}
+
+	msg := []byte{userPasswordVersion, byte(len(d.Username))}
+	msg = append(msg, d.Username...)
+	msg = append(msg, byte(len(d.Password)))
+	msg = append(msg, d.Password...)
+	if _, err := conn.Write(msg); err != nil {
+		return fmt.Errorf("socks: failed to send credentials: %w", err)
+	}
+
+	var status [2]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return fmt.Errorf("socks: failed to read authentication status: %w", err)
+	}
+	if status[1] != 0x00 {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// readReply reads the proxy's answer to CONNECT, discarding the bound
+// address it reports.
+func readReply(conn net.Conn) error {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return fmt.Errorf("socks: failed to read CONNECT reply: %w", err)
+	}
+	if header[0] != version5 {
+		return fmt.Errorf("socks: unexpected protocol version %d", header[0])
+	}
+	if header[1] != 0x00 {
+		return ReplyError(header[1])
+	}
+
+	var addrLen int
+	switch header[3] {
+	case atypIPv4:
+		addrLen = net.IPv4len
+	case atypIPv6:
+		addrLen = net.IPv6len
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return fmt.Errorf("socks: failed to read CONNECT reply: %w", err)
+		}
+		addrLen = int(n[0])
+	default:
+		return fmt.Errorf("socks: unknown address type %#x in reply", header[3])
+	}
+
+	// The bound address and port.
+	if _, err := io.CopyN(io.Discard, conn, int64(addrLen+2)); err != nil {
+		return fmt.Errorf("socks: failed to read CONNECT reply: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"proxy/config"
+)
+
+// CertStore holds the server's certificates, picks one per connection by
+// SNI and can reload them from disk without a restart.
+type CertStore struct {
+	files []config.CertificateConfig
+
+	mu    sync.RWMutex
+	certs []*tls.Certificate
+}
+
+// NewCertStore loads the given certificates. The first one is served to
+// clients whose SNI matches none of them.
+func NewCertStore(files []config.CertificateConfig) (*CertStore, error) {
+	s := &CertStore{files: files}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the certificate files again. On failure the certificates
+// already loaded stay in use.
+func (s *CertStore) Reload() error {
+	certs := make([]*tls.Certificate, 0, len(s.files))
+	for _, f := range s.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %s: %w", f.CertFile, err)
+		}
+		certs = append(certs, &cert)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificates configured")
+	}
+
+	s.mu.Lock()
+	s.certs = certs
+	s.mu.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if hello.ServerName != "" {
+		for _, cert := range s.certs {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
+
+// Watch reloads the certificates whenever one of their files changes, until
+// ctx is done. onReload is called with the outcome of each reload.
+func (s *CertStore) Watch(ctx context.Context, interval time.Duration, onReload func(error)) {
+	changed := make(chan struct{}, 1)
+	for _, f := range s.files {
+		for _, path := range []string{f.CertFile, f.KeyFile} {
+			go config.WatchFile(ctx, path, interval, func() {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			})
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+			// Certificate and key are usually replaced together; give the
+			// second write a moment to land.
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			onReload(s.Reload())
+		}
+	}
+}
+
+// NewServerConfig builds the listener's TLS configuration. Only HTTP/1.1 is
+// offered, as CONNECT tunnels and protocol upgrades need it.
+func NewServerConfig(cfg *config.TLSServerConfig) (*tls.Config, *CertStore, error) {
+	minVersion, err := config.ParseTLSVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	cipherSuites, err := config.ParseCipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	store, err := NewCertStore(cfg.CertificateList())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		NextProtos:     []string{"http/1.1"},
+	}
+
+	if cfg.ClientCerts.Enabled() {
+		if tlsConfig.ClientCAs, err = LoadCertPool(cfg.ClientCerts.CAFile); err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.ClientCerts.Mode == config.ClientCertRequire {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsConfig, store, nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,101 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	maxQueueSize   = 2048
+	maxBatchSize   = 512
+	exportInterval = 5 * time.Second
+	exportTimeout  = 10 * time.Second
+)
+
+// batcher queues finished spans and exports them in the background so
+// request handling never waits on the collector. Spans are dropped when the
+// queue is full.
+type batcher struct {
+	exporter    Exporter
+	serviceName string
+	onError     func(error)
+
+	queue chan *Span
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newBatcher(exporter Exporter, serviceName string, onError func(error)) *batcher {
+	b := &batcher{
+		exporter:    exporter,
+		serviceName: serviceName,
+		onError:     onError,
+		queue:       make(chan *Span, maxQueueSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batcher) enqueue(span *Span) {
+	select {
+	case b.queue <- span:
+	default:
+	}
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span := <-b.queue:
+			batch = append(batch, span)
+			if len(batch) >= maxBatchSize {
+				b.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			b.export(batch)
+			batch = nil
+		case <-b.stop:
+			for {
+				select {
+				case span := <-b.queue:
+					batch = append(batch, span)
+				default:
+					b.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *batcher) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	if err := b.exporter.Export(ctx, b.serviceName, batch); err != nil && b.onError != nil {
+		b.onError(err)
+	}
+}
+
+func (b *batcher) shutdown(ctx context.Context) error {
+	b.once.Do(func() { close(b.stop) })
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return b.exporter.Shutdown(ctx)
+}
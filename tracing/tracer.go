@@ -0,0 +1,200 @@
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+)
+
+type SpanKind int
+
+// Span kinds use the OTLP enum values.
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+type StatusCode int
+
+// Status codes use the OTLP enum values.
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+type Event struct {
+	Name       string
+	Time       time.Time
+	Attributes map[string]interface{}
+}
+
+// Span is one timed operation. All methods are safe on a nil span, which is
+// what a disabled tracer hands out, and safe for concurrent use.
+type Span struct {
+	tracer *Tracer
+
+	Name     string
+	Kind     SpanKind
+	Context  SpanContext
+	ParentID SpanID
+	Start    time.Time
+
+	mu            sync.Mutex
+	End           time.Time
+	Attributes    map[string]interface{}
+	Events        []Event
+	Status        StatusCode
+	StatusMessage string
+	ended         bool
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+func (s *Span) AddEvent(name string, attributes map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Events = append(s.Events, Event{Name: name, Time: time.Now(), Attributes: attributes})
+}
+
+func (s *Span) SetStatus(code StatusCode, message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Status = code
+	s.StatusMessage = message
+}
+
+// SpanContext returns the context to propagate to children of s. A nil span
+// returns the zero value.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// Finish ends the span and hands it to the exporter if it is sampled.
+// Later calls do nothing.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	if s.Context.Sampled() {
+		s.tracer.batcher.enqueue(s)
+	}
+}
+
+type spanKey struct{}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+type remoteKey struct{}
+
+// ContextWithRemote records a span context received from a caller, to be
+// used as the parent of the next span started from ctx.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Tracer starts spans and exports the sampled ones in batches. A nil
+// *Tracer is valid and traces nothing.
+type Tracer struct {
+	serviceName string
+	sampleRatio float64
+	batcher     *batcher
+}
+
+// NewTracer starts a tracer that samples new traces at sampleRatio, from 0
+// (none) to 1 (all).
+func NewTracer(serviceName string, sampleRatio float64, exporter Exporter, onError func(error)) *Tracer {
+	sampleRatio = math.Max(0, math.Min(1, sampleRatio))
+	t := &Tracer{serviceName: serviceName, sampleRatio: sampleRatio}
+	t.batcher = newBatcher(exporter, serviceName, onError)
+	return t
+}
+
+// Start begins a span named name. Its parent is the span in ctx, else a
+// remote span context recorded with ContextWithRemote; without either a new
+// trace is started and sampled at the configured ratio.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:     t,
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+	}
+
+	var parent SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		parent = p.Context
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = remote
+	}
+
+	if parent.IsValid() {
+		span.Context = SpanContext{
+			TraceID:    parent.TraceID,
+			Flags:      parent.Flags,
+			TraceState: parent.TraceState,
+		}
+		span.ParentID = parent.SpanID
+	} else {
+		span.Context.TraceID = newTraceID()
+		if t.sample(span.Context.TraceID) {
+			span.Context.Flags = flagSampled
+		}
+	}
+	span.Context.SpanID = newSpanID()
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// sample decides from the trace ID itself, so every service using the same
+// ratio agrees on which traces to keep.
+func (t *Tracer) sample(id TraceID) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(id[8:])>>1) < t.sampleRatio*(1<<63)
+}
+
+// Shutdown exports any spans still queued and stops the exporter.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.batcher.shutdown(ctx)
+}
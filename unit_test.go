@@ -2,12 +2,23 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"proxy/cache"
 	"proxy/config"
 	"proxy/logging"
+	"proxy/metrics"
+	"proxy/ratelimit"
+	"proxy/tracing"
 )
 
 func TestConfigValidation(t *testing.T) {
@@ -188,4 +199,278 @@ func TestConfigurationFileCreation(t *testing.T) {
 			t.Errorf("Expected default port 8080, got %d", cfg.Server.Port)
 		}
 	})
-}
\ No newline at end of file
+}
+
+func TestPrometheusExposition(t *testing.T) {
+	registry := metrics.NewRegistry()
+	requests := registry.NewCounterVec("test_requests_total", "Requests.", "path")
+	latency := registry.NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1})
+
+	requests.Inc(`/a"b`)
+	requests.Add(2, "/c")
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	var buffer bytes.Buffer
+	if err := registry.WritePrometheus(&buffer); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+
+	expected := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{path="/a\"b"} 1
+test_requests_total{path="/c"} 2
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.55
+test_latency_seconds_count 3
+`
+	if buffer.String() != expected {
+		t.Errorf("Unexpected exposition output:\n%s\nexpected:\n%s", buffer.String(), expected)
+	}
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	store := cache.NewMemoryStore(250)
+
+	for _, key := range []string{"a", "b", "c"} {
+		store.Set(key, &cache.Entry{Key: key, Body: bytes.Repeat([]byte("x"), 99)})
+	}
+
+	if _, ok := store.Get("a"); ok {
+		t.Errorf("Expected least recently used entry to be evicted")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, ok := store.Get(key); !ok {
+			t.Errorf("Expected entry %s to remain cached", key)
+		}
+	}
+	if store.Size() > 250 {
+		t.Errorf("Expected cache size within 250 bytes, got %d", store.Size())
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	limiter := ratelimit.New(10, 1)
+
+	if _, ok, err := limiter.Wait(context.Background(), "host", time.Second); !ok || err != nil {
+		t.Fatalf("Expected the first token to be free, got ok=%v err=%v", ok, err)
+	}
+	if _, ok := limiter.Reserve("host", 0); ok {
+		t.Fatal("Expected no token to be left")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := limiter.Wait(ctx, "host", time.Second); err == nil {
+		t.Fatal("Expected the wait to end with the context")
+	}
+
+	// Neither the rejected nor the cancelled request kept a token, so one
+	// has refilled by now.
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := limiter.Reserve("host", 0); !ok {
+		t.Error("Expected the token given up by the cancelled wait to be available")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	file, err := logging.OpenRotatingFile(path, logging.RotateOptions{
+		MaxBytes: 20,
+		Compress: true,
+		Header:   []byte("#header\n"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open rotating file: %v", err)
+	}
+
+	for _, line := range []string{"first line\n", "second line\n", "third line\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	current, _ := os.ReadFile(path)
+	if string(current) != "#header\nthird line\n" {
+		t.Errorf("Expected header and last line in current file, got %q", current)
+	}
+
+	rotated, _ := filepath.Glob(path + ".*.gz")
+	if len(rotated) != 2 {
+		t.Fatalf("Expected 2 compressed rotated files, got %v", rotated)
+	}
+
+	f, err := os.Open(rotated[0])
+	if err != nil {
+		t.Fatalf("Failed to open rotated file: %v", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Rotated file is not gzip: %v", err)
+	}
+	data, _ := io.ReadAll(zr)
+	if !strings.HasPrefix(string(data), "#header\n") {
+		t.Errorf("Expected rotated file to start with header, got %q", data)
+	}
+
+	t.Run("Failed rotation keeps logging", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "access.log")
+		file, err := logging.OpenRotatingFile(path, logging.RotateOptions{MaxBytes: 1024})
+		if err != nil {
+			t.Fatalf("Failed to open rotating file: %v", err)
+		}
+		defer file.Close()
+
+		// With the file gone there is nothing to rename.
+		os.Remove(path)
+		if err := file.Rotate(); err == nil {
+			t.Fatal("Expected rotation to fail")
+		}
+
+		if _, err := file.Write([]byte("after failure\n")); err != nil {
+			t.Fatalf("Write after failed rotation failed: %v", err)
+		}
+		data, _ := os.ReadFile(path)
+		if string(data) != "after failure\n" {
+			t.Errorf("Expected write to land in %s, got %q", path, data)
+		}
+	})
+
+	t.Run("Failed reopen keeps the old file", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "access.log")
+		file, err := logging.OpenRotatingFile(path, logging.RotateOptions{})
+		if err != nil {
+			t.Fatalf("Failed to open rotating file: %v", err)
+		}
+		defer file.Close()
+
+		moved := filepath.Join(dir, "moved.log")
+		os.Rename(path, moved)
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := file.Reopen(); err == nil {
+			t.Fatal("Expected reopen to fail")
+		}
+
+		if _, err := file.Write([]byte("after failure\n")); err != nil {
+			t.Fatalf("Write after failed reopen failed: %v", err)
+		}
+		data, _ := os.ReadFile(moved)
+		if string(data) != "after failure\n" {
+			t.Errorf("Expected write to land in the old file, got %q", data)
+		}
+	})
+}
+
+func TestLogFileOutput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.log")
+
+	logger := logging.NewLogger(&config.LoggingConfig{
+		Level:      "info",
+		Format:     "json",
+		Output:     path,
+		MaxBytes:   2048,
+		MaxBackups: 2,
+	})
+
+	t.Run("Concurrent writes stay intact", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					logger.Info("Request completed", map[string]interface{}{
+						"worker": worker,
+						"n":      j,
+					})
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		files, _ := filepath.Glob(path + "*")
+		if len(files) != 3 {
+			t.Errorf("Expected current file plus 2 backups, got %v", files)
+		}
+		for _, name := range files {
+			data, _ := os.ReadFile(name)
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				var entry logging.LogEntry
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("Corrupt log line in %s: %q", name, line)
+				}
+			}
+		}
+	})
+
+	t.Run("Reopen after external rotation", func(t *testing.T) {
+		moved := filepath.Join(dir, "moved.log")
+		if err := os.Rename(path, moved); err != nil {
+			t.Fatalf("Failed to move log file: %v", err)
+		}
+		if err := logger.Reopen(); err != nil {
+			t.Fatalf("Reopen failed: %v", err)
+		}
+
+		logger.Info("After reopen", nil)
+		logger.Close()
+
+		data, _ := os.ReadFile(path)
+		if !strings.Contains(string(data), "After reopen") {
+			t.Errorf("Expected new entries in reopened file, got %q", data)
+		}
+	})
+}
+
+func TestTraceSampling(t *testing.T) {
+	for ratio, want := range map[float64]bool{0: false, 1: true} {
+		tracer := tracing.NewTracer("test", ratio, tracing.NewWriterExporter(io.Discard), nil)
+		for i := 0; i < 20; i++ {
+			if _, span := tracer.Start(context.Background(), "request", tracing.KindServer); span.SpanContext().Sampled() != want {
+				t.Errorf("Ratio %v: expected sampled=%v", ratio, want)
+				break
+			}
+		}
+		tracer.Shutdown(context.Background())
+	}
+}
+
+func TestTraceparentParsing(t *testing.T) {
+	valid := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := tracing.ParseTraceparent(valid)
+	if !ok || !sc.Sampled() || sc.Traceparent() != valid {
+		t.Errorf("Expected %q to round-trip, got %q (ok=%v)", valid, sc.Traceparent(), ok)
+	}
+
+	for _, value := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, ok := tracing.ParseTraceparent(value); ok {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+
+	if _, ok := tracing.ParseTraceparent(strings.Replace(valid, "00-", "01-", 1) + "-future"); !ok {
+		t.Errorf("Expected a future version with extra fields to be accepted")
+	}
+}